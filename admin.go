@@ -0,0 +1,453 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	connectingState = "connecting"
+	idleState       = "idle"
+	sendingState    = "sending"
+
+	adminPrefix = "/admin/"
+)
+
+var adminLog = NewLogger("admin")
+
+// WorkerInfo is the state of a backend or frontend worker, and the outcome
+// of its last purge.
+type WorkerInfo struct {
+	Layer       string
+	Addr        string
+	State       string
+	Since       time.Time
+	Sent        uint64
+	Errors      uint64
+	LastError   string    `json:",omitempty"`
+	LastErrorAt time.Time `json:",omitempty"`
+	LastSuccess time.Time `json:",omitempty"`
+}
+
+// WorkerStatus is updated by a worker as it processes purges.
+type WorkerStatus struct {
+	mutex  sync.Mutex
+	info   WorkerInfo
+	client PurgeClient
+}
+
+var (
+	workersMutex sync.Mutex
+	workers      []*WorkerStatus
+)
+
+// registerWorker returns the WorkerStatus of a new worker sending purges to
+// addr.
+func registerWorker(layer, addr string) *WorkerStatus {
+	status := &WorkerStatus{info: WorkerInfo{Layer: layer, Addr: addr, State: idleState, Since: time.Now()}}
+
+	workersMutex.Lock()
+	workers = append(workers, status)
+	workersMutex.Unlock()
+	workerCount.With(prometheus.Labels{layerLabel: layer}).Inc()
+
+	return status
+}
+
+func (s *WorkerStatus) setState(state string) {
+	s.mutex.Lock()
+	s.info.State = state
+	s.info.Since = time.Now()
+	s.mutex.Unlock()
+}
+
+// unregister removes the status of a stopped worker.
+func (s *WorkerStatus) unregister() {
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+
+	for i, status := range workers {
+		if status == s {
+			workers = append(workers[:i], workers[i+1:]...)
+			workerCount.With(prometheus.Labels{layerLabel: s.info.Layer}).Dec()
+			return
+		}
+	}
+}
+
+// setClient records the client of a worker done connecting to the cache.
+func (s *WorkerStatus) setClient(client PurgeClient) {
+	s.mutex.Lock()
+	s.client = client
+	s.info.State = idleState
+	s.info.Since = time.Now()
+	s.mutex.Unlock()
+}
+
+// done records the outcome of a purge and sets the worker back to idle.
+func (s *WorkerStatus) done(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	s.info.State = idleState
+	s.info.Since = now
+	s.info.Sent++
+
+	if err != nil {
+		s.info.Errors++
+		s.info.LastError = err.Error()
+		s.info.LastErrorAt = now
+	} else {
+		s.info.LastSuccess = now
+	}
+}
+
+func (s *WorkerStatus) snapshot() WorkerInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.info
+}
+
+// workerSnapshots returns the status of all workers.
+func workerSnapshots() []WorkerInfo {
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+
+	snapshots := make([]WorkerInfo, 0, len(workers))
+	for _, status := range workers {
+		snapshots = append(snapshots, status.snapshot())
+	}
+
+	return snapshots
+}
+
+// DestinationStatus summarizes the status of the workers sending purges to
+// a cache layer.
+type DestinationStatus struct {
+	Layer       string
+	Addr        string
+	Connected   bool
+	Workers     int
+	LastError   string    `json:",omitempty"`
+	LastErrorAt time.Time `json:",omitempty"`
+	LastSuccess time.Time `json:",omitempty"`
+}
+
+// destinationStatuses returns the status of each destination. A destination
+// is considered connected if all its workers are, and the last purge sent by
+// each of them succeeded.
+func destinationStatuses(snapshots []WorkerInfo) []DestinationStatus {
+	byAddr := make(map[string]*DestinationStatus)
+	var keys []string
+
+	for _, w := range snapshots {
+		key := w.Layer + " " + w.Addr
+		d, ok := byAddr[key]
+		if !ok {
+			d = &DestinationStatus{Layer: w.Layer, Addr: w.Addr, Connected: true}
+			byAddr[key] = d
+			keys = append(keys, key)
+		}
+
+		d.Workers++
+		if w.State == connectingState || w.LastErrorAt.After(w.LastSuccess) {
+			d.Connected = false
+		}
+		if w.LastErrorAt.After(d.LastErrorAt) {
+			d.LastError, d.LastErrorAt = w.LastError, w.LastErrorAt
+		}
+		if w.LastSuccess.After(d.LastSuccess) {
+			d.LastSuccess = w.LastSuccess
+		}
+	}
+
+	sort.Strings(keys)
+	statuses := make([]DestinationStatus, 0, len(keys))
+	for _, key := range keys {
+		statuses = append(statuses, *byAddr[key])
+	}
+
+	return statuses
+}
+
+// AdminServer implements an HTTP API to inspect and control purged at
+// runtime.
+type AdminServer struct {
+	Token string
+	// Whether to only serve the endpoints which do not change the state of
+	// purged, when the API is exposed without authentication
+	ReadOnly   bool
+	Ingresses  map[string]*Ingress
+	Queue      *PriorityQueue
+	ChFrontend chan Purge
+	Spool      *PrioritySpool
+	Filter     *HostFilter
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// authorized checks the bearer token of req, if a token is configured.
+func (a *AdminServer) authorized(req *http.Request) bool {
+	if a.Token == "" {
+		return true
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+// Handler returns the http.Handler serving the admin API under /admin/.
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix+"config", a.handleConfig)
+	mux.HandleFunc(adminPrefix+"status", a.handleStatus)
+	mux.HandleFunc(adminPrefix+"host_regex", a.handleHostRegex)
+	if !a.ReadOnly {
+		mux.HandleFunc(adminPrefix+"sources/", a.handleSource)
+		mux.HandleFunc(adminPrefix+"drain", a.handleDrain)
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !a.authorized(req) {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(rw, req)
+	})
+}
+
+// handleConfig shows the value of all flags.
+func (a *AdminServer) handleConfig(rw http.ResponseWriter, req *http.Request) {
+	config := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		config[f.Name] = f.Value.String()
+	})
+
+	// Do not disclose secrets
+	for name, value := range config {
+		config[name] = redact(name, value)
+	}
+
+	if re := a.Filter.Get(); re != nil {
+		config["host_regex"] = re.String()
+	} else {
+		config["host_regex"] = ""
+	}
+
+	writeJSON(rw, config)
+}
+
+type sourceStatus struct {
+	Policy string
+	Paused bool
+}
+
+type adminStatus struct {
+	Backlog      map[string]interface{}
+	Sources      map[string]sourceStatus
+	Workers      []WorkerInfo
+	Destinations []DestinationStatus
+}
+
+// handleStatus shows backlog sizes, sources, workers and destinations.
+func (a *AdminServer) handleStatus(rw http.ResponseWriter, req *http.Request) {
+	status := adminStatus{
+		Backlog: map[string]interface{}{
+			backendValue:  a.Queue.Len(),
+			frontendValue: len(a.ChFrontend),
+		},
+		Sources: make(map[string]sourceStatus),
+		Workers: workerSnapshots(),
+	}
+
+	if a.Spool != nil {
+		status.Backlog["spool"] = a.Spool.Len()
+	}
+
+	for name, ingress := range a.Ingresses {
+		status.Sources[name] = sourceStatus{Policy: ingress.policy, Paused: ingress.Paused()}
+	}
+
+	status.Destinations = destinationStatuses(status.Workers)
+
+	writeJSON(rw, status)
+}
+
+// handleSource pauses or resumes consumption from a source:
+// POST /admin/sources/<source>/pause or /admin/sources/<source>/resume
+func (a *AdminServer) handleSource(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, adminPrefix+"sources/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(rw, req)
+		return
+	}
+
+	ingress, ok := a.Ingresses[parts[0]]
+	if !ok {
+		http.Error(rw, fmt.Sprintf("Unknown source %s", parts[0]), http.StatusNotFound)
+		return
+	}
+
+	switch parts[1] {
+	case "pause":
+		ingress.Pause()
+	case "resume":
+		ingress.Resume()
+	default:
+		http.NotFound(rw, req)
+		return
+	}
+
+	adminLog.Info("Source state changed", "source", parts[0], "action", parts[1])
+	writeJSON(rw, sourceStatus{Policy: ingress.policy, Paused: ingress.Paused()})
+}
+
+// handleDrain discards all queued purges.
+func (a *AdminServer) handleDrain(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	drained := map[string]int64{
+		backendValue: int64(a.Queue.Drain()),
+	}
+
+	if a.Spool != nil {
+		drained["spool"] = a.Spool.Drain()
+	}
+
+	var n int64
+	for done := false; !done; {
+		select {
+		case p := <-a.ChFrontend:
+			finishPurge(p, droppedResult)
+			n++
+		default:
+			done = true
+		}
+	}
+	drained[frontendValue] = n
+
+	adminLog.Info("Drained queues", backendValue, drained[backendValue], frontendValue, drained[frontendValue], "spool", drained["spool"])
+	writeJSON(rw, drained)
+}
+
+// handleHostRegex shows or changes the host regex. An empty regex lets all
+// hostnames through.
+func (a *AdminServer) handleHostRegex(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		if a.ReadOnly {
+			http.Error(rw, "Changing the host regex requires -admin_token or -admin_addr", http.StatusForbidden)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var re *regexp.Regexp
+		if value := strings.TrimSpace(string(body)); value != "" {
+			re, err = regexp.Compile(value)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		a.Filter.Set(re)
+		adminLog.Info("Host regex changed", "host_regex", strings.TrimSpace(string(body)))
+	default:
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	value := ""
+	if re := a.Filter.Get(); re != nil {
+		value = re.String()
+	}
+	writeJSON(rw, map[string]string{"host_regex": value})
+}
+
+// adminReadOnly returns true if the admin API served on addr should not allow
+// changing the state of purged. Without a token, only a unix socket, whose
+// access is restricted by its permissions, is trusted. An empty addr means
+// the metrics listener.
+func adminReadOnly(addr, token string) bool {
+	return token == "" && !strings.HasPrefix(addr, "unix:")
+}
+
+// listen returns a listener for addr, which is either a TCP address or a
+// unix socket path prefixed by unix:. The socket is given the specified
+// permissions.
+func listen(addr string, mode string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid socket mode %s: %v", mode, err)
+	}
+
+	// Remove the socket left behind by a previous run, if any
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
@@ -0,0 +1,219 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupAdminTest(t *testing.T, token string) *AdminServer {
+	queue, err := NewPriorityQueue("urgent:2,normal:1", "source=multicast:urgent", "normal", 10)
+	assertNotErr(t, err)
+
+	ingress, _ := NewIngress(multicastValue, map[string]string{}, queue, nil)
+
+	return &AdminServer{
+		Token:      token,
+		Ingresses:  map[string]*Ingress{multicastValue: ingress},
+		Queue:      queue,
+		ChFrontend: make(chan Purge, 10),
+		Filter:     NewHostFilter(nil),
+	}
+}
+
+func adminRequest(admin *AdminServer, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rw := httptest.NewRecorder()
+	admin.Handler().ServeHTTP(rw, req)
+	return rw
+}
+
+func TestAdminAuth(t *testing.T) {
+	admin := setupAdminTest(t, "secret")
+
+	assertEquals(t, adminRequest(admin, "GET", "/admin/status", "", "").Code, http.StatusUnauthorized)
+	assertEquals(t, adminRequest(admin, "GET", "/admin/status", "", "wrong").Code, http.StatusUnauthorized)
+	assertEquals(t, adminRequest(admin, "GET", "/admin/status", "", "secret").Code, http.StatusOK)
+
+	// The token is not disclosed
+	*adminToken = "secret"
+	defer func() { *adminToken = "" }()
+	rw := adminRequest(admin, "GET", "/admin/config", "", "secret")
+	var config map[string]string
+	assertNotErr(t, json.Unmarshal(rw.Body.Bytes(), &config))
+	assertEquals(t, config["admin_token"], "<redacted>")
+	assertEquals(t, config["backend_addr"], *backendAddr)
+
+	// Neither are the headers sent to the caches
+	*backendHeaders = "X-Purge-Token:secret"
+	defer func() { *backendHeaders = "" }()
+	rw = adminRequest(admin, "GET", "/admin/config", "", "secret")
+	assertNotErr(t, json.Unmarshal(rw.Body.Bytes(), &config))
+	assertEquals(t, config["backend_purge_headers"], "<redacted>")
+	assertEquals(t, config["frontend_purge_headers"], "")
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	admin := setupAdminTest(t, "")
+	admin.ReadOnly = true
+
+	assertEquals(t, adminRequest(admin, "GET", "/admin/status", "", "").Code, http.StatusOK)
+	assertEquals(t, adminRequest(admin, "GET", "/admin/host_regex", "", "").Code, http.StatusOK)
+
+	// Nothing can be changed
+	assertEquals(t, adminRequest(admin, "POST", "/admin/sources/multicast/pause", "", "").Code, http.StatusNotFound)
+	assertEquals(t, adminRequest(admin, "POST", "/admin/drain", "", "").Code, http.StatusNotFound)
+	assertEquals(t, adminRequest(admin, "PUT", "/admin/host_regex", "^upload\\.", "").Code, http.StatusForbidden)
+	assertEquals(t, admin.Filter.Match("en.wikipedia.org"), true)
+}
+
+func TestAdminReadOnlyAddr(t *testing.T) {
+	// Metrics listener or TCP listener, without a token
+	assertEquals(t, adminReadOnly("", ""), true)
+	assertEquals(t, adminReadOnly("127.0.0.1:2113", ""), true)
+
+	assertEquals(t, adminReadOnly("unix:/run/purged/admin.sock", ""), false)
+	assertEquals(t, adminReadOnly("", "secret"), false)
+	assertEquals(t, adminReadOnly("127.0.0.1:2113", "secret"), false)
+}
+
+func TestAdminStatus(t *testing.T) {
+	admin := setupAdminTest(t, "")
+	admin.Queue.Push(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: multicastValue})
+	admin.ChFrontend <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+
+	rw := adminRequest(admin, "GET", "/admin/status", "", "")
+	assertEquals(t, rw.Code, http.StatusOK)
+
+	var status struct {
+		Backlog struct {
+			Backend  map[string]int
+			Frontend int
+		}
+		Sources map[string]sourceStatus
+	}
+	assertNotErr(t, json.Unmarshal(rw.Body.Bytes(), &status))
+	assertEquals(t, status.Backlog.Backend["urgent"], 1)
+	assertEquals(t, status.Backlog.Backend["normal"], 0)
+	assertEquals(t, status.Backlog.Frontend, 1)
+	assertEquals(t, status.Sources[multicastValue].Paused, false)
+}
+
+func TestAdminPauseResume(t *testing.T) {
+	admin := setupAdminTest(t, "")
+
+	assertEquals(t, adminRequest(admin, "GET", "/admin/sources/multicast/pause", "", "").Code, http.StatusMethodNotAllowed)
+	assertEquals(t, adminRequest(admin, "POST", "/admin/sources/kafka/pause", "", "").Code, http.StatusNotFound)
+
+	assertEquals(t, adminRequest(admin, "POST", "/admin/sources/multicast/pause", "", "").Code, http.StatusOK)
+	assertEquals(t, admin.Ingresses[multicastValue].Paused(), true)
+
+	assertEquals(t, adminRequest(admin, "POST", "/admin/sources/multicast/resume", "", "").Code, http.StatusOK)
+	assertEquals(t, admin.Ingresses[multicastValue].Paused(), false)
+}
+
+func TestAdminDrain(t *testing.T) {
+	admin := setupAdminTest(t, "")
+	admin.Queue.Push(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: multicastValue})
+	admin.Queue.Push(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"})
+	admin.ChFrontend <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+
+	rw := adminRequest(admin, "POST", "/admin/drain", "", "")
+	var drained map[string]int
+	assertNotErr(t, json.Unmarshal(rw.Body.Bytes(), &drained))
+	assertEquals(t, drained[backendValue], 2)
+	assertEquals(t, drained[frontendValue], 1)
+	assertEquals(t, len(admin.ChFrontend), 0)
+}
+
+func TestAdminHostRegex(t *testing.T) {
+	admin := setupAdminTest(t, "")
+
+	assertEquals(t, adminRequest(admin, "PUT", "/admin/host_regex", "[", "").Code, http.StatusBadRequest)
+	assertEquals(t, admin.Filter.Match("en.wikipedia.org"), true)
+
+	assertEquals(t, adminRequest(admin, "PUT", "/admin/host_regex", "^upload\\.", "").Code, http.StatusOK)
+	assertEquals(t, admin.Filter.Match("en.wikipedia.org"), false)
+	assertEquals(t, admin.Filter.Match("upload.wikimedia.org"), true)
+
+	rw := adminRequest(admin, "GET", "/admin/host_regex", "", "")
+	assertEquals(t, strings.Contains(rw.Body.String(), "upload"), true)
+
+	// An empty regex lets everything through
+	adminRequest(admin, "PUT", "/admin/host_regex", "", "")
+	assertEquals(t, admin.Filter.Match("en.wikipedia.org"), true)
+}
+
+func TestDestinationStatuses(t *testing.T) {
+	now := time.Now()
+	statuses := destinationStatuses([]WorkerInfo{
+		{Layer: backendValue, Addr: "127.0.0.1:3128", State: idleState, LastSuccess: now},
+		{Layer: backendValue, Addr: "127.0.0.1:3128", State: sendingState, LastSuccess: now.Add(-time.Second)},
+		{Layer: frontendValue, Addr: "127.0.0.1:80", State: idleState, LastSuccess: now.Add(-time.Second), LastErrorAt: now, LastError: "EOF"},
+	})
+
+	assertEquals(t, len(statuses), 2)
+	assertEquals(t, statuses[0].Layer, backendValue)
+	assertEquals(t, statuses[0].Workers, 2)
+	assertEquals(t, statuses[0].Connected, true)
+	assertEquals(t, statuses[1].Connected, false)
+	assertEquals(t, statuses[1].LastError, "EOF")
+}
+
+func TestWorkerStatus(t *testing.T) {
+	status := registerWorker(backendValue, "127.0.0.1:3128")
+	status.setState(sendingState)
+	assertEquals(t, status.snapshot().State, sendingState)
+
+	status.done(errors.New("EOF"))
+	info := status.snapshot()
+	assertEquals(t, info.State, idleState)
+	assertEquals(t, info.Sent, uint64(1))
+	assertEquals(t, info.Errors, uint64(1))
+	assertEquals(t, info.LastError, "EOF")
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-admin")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "admin.sock")
+	ln, err := listen("unix:"+path, "0660")
+	assertNotErr(t, err)
+	defer ln.Close()
+
+	fi, err := os.Stat(path)
+	assertNotErr(t, err)
+	assertEquals(t, fi.Mode().Perm(), os.FileMode(0660))
+
+	_, err = listen("unix:"+path, "rw")
+	expectErr(t, err)
+}
@@ -0,0 +1,283 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// Outcome of audited purges
+	sentResult     = "sent"
+	failedResult   = "failed"
+	deniedResult   = "denied"
+	droppedResult  = "dropped"
+	filteredResult = "filtered"
+	invalidResult  = "invalid"
+	expiredResult  = "expired"
+)
+
+var (
+	auditErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "purged_audit_errors_total",
+		Help: "Total number of audit log records which could not be written",
+	})
+
+	auditErrorLog = NewLogger("audit").Limited()
+)
+
+// AuditRecord is the history of a purge sampled for the audit log. It travels
+// along with the purge and is written once the purge has been sent to all
+// layers, or discarded.
+type AuditRecord struct {
+	URL            string
+	Source         string
+	Topic          string `json:",omitempty"`
+	Partition      *int32 `json:",omitempty"`
+	Offset         *int64 `json:",omitempty"`
+	EventID        string `json:",omitempty"`
+	RequestID      string `json:",omitempty"`
+	Layer          string `json:",omitempty"`
+	Received       time.Time
+	EventTime      *time.Time `json:",omitempty"`
+	BackendSent    *time.Time `json:",omitempty"`
+	BackendStatus  string     `json:",omitempty"`
+	FrontendSent   *time.Time `json:",omitempty"`
+	FrontendStatus string     `json:",omitempty"`
+	Result         string
+	// Whether the last attempt at sending to each layer failed
+	BackendFailed  bool `json:",omitempty"`
+	FrontendFailed bool `json:",omitempty"`
+
+	// The audit log the record is written to
+	log *AuditLog
+}
+
+// sent records the outcome of sending the purge to layer.
+func (r *AuditRecord) sent(layer string, status string, err error, t time.Time) {
+	if r == nil {
+		return
+	}
+
+	if layer == backendValue {
+		r.BackendSent, r.BackendStatus, r.BackendFailed = &t, status, err != nil
+	} else {
+		r.FrontendSent, r.FrontendStatus, r.FrontendFailed = &t, status, err != nil
+	}
+}
+
+// failed records that sending the purge to layer failed for good.
+func (r *AuditRecord) failed(layer string) {
+	if r == nil {
+		return
+	}
+
+	if layer == backendValue {
+		r.BackendFailed = true
+	} else {
+		r.FrontendFailed = true
+	}
+}
+
+// auditFilter selects the purges to audit. Conditions left empty match any
+// purge.
+type auditFilter struct {
+	host *regexp.Regexp
+	path string
+}
+
+// rotatingFile is a file rotated once it reaches maxBytes, keeping the given
+// number of backups named path.1, path.2 and so on.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	backups  int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+
+	if r.backups == 0 {
+		os.Remove(r.path)
+	} else {
+		for i := r.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		os.Rename(r.path, r.path+".1")
+	}
+
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// AuditLog writes one JSON record for each sampled purge, to find out whether
+// and when purged received and sent the purge for a given URL. A nil AuditLog
+// audits nothing.
+type AuditLog struct {
+	mutex  sync.Mutex
+	w      io.WriteCloser
+	filter atomic.Value
+}
+
+// NewAuditLog returns an AuditLog writing to dest, either a file rotated at
+// maxBytes or unix:/path/to/socket for a datagram socket, one record per
+// datagram.
+func NewAuditLog(dest string, maxBytes int64, backups int) (*AuditLog, error) {
+	a := &AuditLog{}
+	a.filter.Store(auditFilter{})
+
+	var err error
+	if strings.HasPrefix(dest, "unix:") {
+		a.w, err = net.Dial("unixgram", strings.TrimPrefix(dest, "unix:"))
+	} else {
+		a.w, err = openRotatingFile(dest, maxBytes, backups)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// SetFilter restricts auditing to the purges with a hostname matching the
+// host regex and a path starting with path.
+func (a *AuditLog) SetFilter(host, path string) error {
+	f := auditFilter{path: path}
+	if host != "" {
+		var err error
+		if f.host, err = regexp.Compile(host); err != nil {
+			return err
+		}
+	}
+
+	a.filter.Store(f)
+	return nil
+}
+
+// Start returns the AuditRecord of p, or nil if p is not to be audited. A
+// fraction -audit_sample_rate of the purges matching the filter is audited.
+func (a *AuditLog) Start(p Purge) *AuditRecord {
+	if a == nil || rand.Float64() >= auditSampleRate.Load() {
+		return nil
+	}
+
+	f := a.filter.Load().(auditFilter)
+	if f.host != nil || f.path != "" {
+		u, err := url.Parse(p.URL)
+		if err != nil || f.host != nil && !f.host.MatchString(u.Host) || !strings.HasPrefix(u.Path, f.path) {
+			return nil
+		}
+	}
+
+	r := &AuditRecord{Received: p.Received, log: a}
+	if !p.EventTime.IsZero() {
+		t := p.EventTime
+		r.EventTime = &t
+	}
+	return r
+}
+
+// Finish writes the AuditRecord of p, if any, with the given result.
+func (a *AuditLog) Finish(p Purge, result string) {
+	r := p.Audit
+	if a == nil || r == nil {
+		return
+	}
+
+	if result == sentResult && (r.BackendFailed || r.FrontendFailed) {
+		result = failedResult
+	}
+	r.URL, r.Source, r.Topic, r.Layer, r.Result = p.URL, p.Source, p.Topic, p.Layer, result
+	r.EventID, r.RequestID = p.EventID, p.RequestID
+	if p.Topic != "" {
+		r.Partition, r.Offset = &p.Partition, &p.Offset
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		auditErrors.Inc()
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	_, err = a.w.Write(line)
+	a.mutex.Unlock()
+
+	if err != nil {
+		auditErrors.Inc()
+		auditErrorLog.Error("Error writing audit record", "err", err)
+	}
+}
+
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.w.Close()
+}
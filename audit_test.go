@@ -0,0 +1,243 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAuditRecords(t *testing.T, path string) []AuditRecord {
+	f, err := os.Open(path)
+	assertNotErr(t, err)
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		assertNotErr(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-audit")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	f, err := openRotatingFile(path, 10, 2)
+	assertNotErr(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		assertNotErr(t, err)
+	}
+	f.Close()
+
+	for name, expected := range map[string]string{
+		"audit.log":   "fourth\n",
+		"audit.log.1": "third\n",
+		"audit.log.2": "second\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assertNotErr(t, err)
+		assertEquals(t, string(data), expected)
+	}
+
+	// Appending to an existing file
+	f, err = openRotatingFile(path, 10, 2)
+	assertNotErr(t, err)
+	assertEquals(t, f.size, int64(len("fourth\n")))
+	f.Close()
+}
+
+func TestAuditLogSampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-audit")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	a, err := NewAuditLog(filepath.Join(dir, "audit.log"), 0, 0)
+	assertNotErr(t, err)
+	defer a.Close()
+
+	p := Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Received: time.Now()}
+
+	// No AuditLog
+	assertEquals(t, (*AuditLog)(nil).Start(p) == nil, true)
+
+	assertEquals(t, a.Start(p) != nil, true)
+
+	defer auditSampleRate.Set(auditSampleRate.String())
+	auditSampleRate.Set("0")
+	assertEquals(t, a.Start(p) == nil, true)
+	auditSampleRate.Set("1")
+
+	expectErr(t, a.SetFilter("(", ""))
+	assertNotErr(t, a.SetFilter(`^en\.wikipedia\.org$`, "/wiki/Main"))
+	assertEquals(t, a.Start(p) != nil, true)
+	assertEquals(t, a.Start(Purge{URL: "https://it.wikipedia.org/wiki/Main_Page"}) == nil, true)
+	assertEquals(t, a.Start(Purge{URL: "https://en.wikipedia.org/w/index.php"}) == nil, true)
+}
+
+func TestAuditLogFinish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-audit")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	a, err := NewAuditLog(path, 0, 0)
+	assertNotErr(t, err)
+	defer a.Close()
+
+	received := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	event := received.Add(-time.Second)
+
+	p := Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue, Topic: "eqiad.resource-purge", Received: received, EventTime: event}
+	p.Audit = a.Start(p)
+	p.Audit.sent(backendValue, "200", nil, received.Add(time.Millisecond))
+	p.Audit.sent(frontendValue, "503", errors.New("Service Unavailable"), received.Add(2*time.Millisecond))
+	a.Finish(p, sentResult)
+
+	p = Purge{URL: "https://en.wikipedia.org/wiki/Special:Random", Source: multicastValue, Received: received}
+	p.Audit = a.Start(p)
+	a.Finish(p, deniedResult)
+
+	// Not sampled
+	a.Finish(Purge{URL: "https://en.wikipedia.org/"}, sentResult)
+
+	records := readAuditRecords(t, path)
+	assertEquals(t, len(records), 2)
+
+	r := records[0]
+	assertEquals(t, r.URL, "https://en.wikipedia.org/wiki/Main_Page")
+	assertEquals(t, r.Source, kafkaValue)
+	assertEquals(t, r.Topic, "eqiad.resource-purge")
+	assertEquals(t, r.Received.Equal(received), true)
+	assertEquals(t, r.EventTime.Equal(event), true)
+	assertEquals(t, r.BackendSent.Equal(received.Add(time.Millisecond)), true)
+	assertEquals(t, r.BackendStatus, "200")
+	assertEquals(t, r.FrontendStatus, "503")
+	assertEquals(t, r.Result, failedResult)
+
+	r = records[1]
+	assertEquals(t, r.Result, deniedResult)
+	assertEquals(t, r.EventTime == nil, true)
+	assertEquals(t, r.BackendSent == nil, true)
+}
+
+func TestAuditLogSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-audit")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.sock")
+	conn, err := net.ListenPacket("unixgram", path)
+	assertNotErr(t, err)
+	defer conn.Close()
+
+	a, err := NewAuditLog("unix:"+path, 0, 0)
+	assertNotErr(t, err)
+	defer a.Close()
+
+	p := Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: httpValue}
+	p.Audit = a.Start(p)
+	a.Finish(p, droppedResult)
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assertNotErr(t, err)
+
+	var r AuditRecord
+	assertNotErr(t, json.Unmarshal(buf[:n], &r))
+	assertEquals(t, r.Source, httpValue)
+	assertEquals(t, r.Result, droppedResult)
+}
+
+func TestAuditLogWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-audit")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	auditLog, err := NewAuditLog(path, 0, 0)
+	assertNotErr(t, err)
+	defer auditLog.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	queue := make(chan Purge, 10)
+	in, err := NewIngress(kafkaValue, nil, chanQueue(queue), nil)
+	assertNotErr(t, err)
+	rules, err := parseRule("deny path=/wiki/Special:", "special")
+	assertNotErr(t, err)
+	in.Rules = NewRuleEngine(RuleSet{rules})
+	in.AuditLog = auditLog
+
+	chin := make(chan Purge, 10)
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue}
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Special:Random", Source: kafkaValue}
+	ran := make(chan struct{})
+	go func() {
+		in.Run(chin)
+		close(ran)
+	}()
+	defer func() {
+		close(chin)
+		<-ran
+	}()
+
+	chFrontend := make(chan Purge, 10)
+	backends, frontends := startWorkers(serverURL.Host, serverURL.Host, queue, chFrontend, nil)
+	defer backends.Resize(0)
+	defer frontends.Resize(0)
+
+	var records []AuditRecord
+	for deadline := time.Now().Add(5 * time.Second); len(records) < 2 && time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		records = readAuditRecords(t, path)
+	}
+	assertEquals(t, len(records), 2)
+
+	for _, r := range records {
+		if strings.HasSuffix(r.URL, "Main_Page") {
+			assertEquals(t, r.Result, sentResult)
+			assertEquals(t, r.BackendStatus, "200")
+			assertEquals(t, r.FrontendStatus, "200")
+			assertEquals(t, r.Received.IsZero(), false)
+		} else {
+			assertEquals(t, r.Result, deniedResult)
+		}
+	}
+}
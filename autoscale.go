@@ -0,0 +1,131 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// How often worker pools are resized with -autoscale_workers
+const autoscaleInterval = 5 * time.Second
+
+var (
+	workerCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "purged_workers",
+		Help: "Number of purger goroutines running, each with its own connection to the cache",
+	}, []string{
+		layerLabel,
+	})
+
+	// Time spent sending requests to each layer since the last autoscaling
+	layerLatency = map[string]*sendLatency{
+		backendValue:  {},
+		frontendValue: {},
+	}
+
+	autoscaleLog = NewLogger("autoscale")
+)
+
+// sendLatency accumulates the time spent sending requests to a cache layer.
+type sendLatency struct {
+	nanos int64
+	count int64
+}
+
+func (l *sendLatency) observe(d time.Duration) {
+	atomic.AddInt64(&l.nanos, int64(d))
+	atomic.AddInt64(&l.count, 1)
+}
+
+// reset returns the average latency observed since the last reset, or zero
+// if no request was sent.
+func (l *sendLatency) reset() time.Duration {
+	nanos := atomic.SwapInt64(&l.nanos, 0)
+	count := atomic.SwapInt64(&l.count, 0)
+	if count == 0 {
+		return 0
+	}
+	return time.Duration(nanos / count)
+}
+
+// Autoscaler grows and shrinks a WorkerPool between Min and Max workers.
+// Workers are added while the backlog of each worker exceeds
+// -autoscale_backlog, and removed once the backlog is empty. When the
+// average latency exceeds -autoscale_latency, the cache is considered
+// overloaded and workers are removed regardless of the backlog.
+type Autoscaler struct {
+	Pool     *WorkerPool
+	Min, Max *atomicInt
+	// Backlog returns the number of purges waiting for a worker
+	Backlog func() int
+	Latency *sendLatency
+}
+
+// step resizes the pool given its backlog and the average latency since the
+// last step, returning the new size.
+func (a *Autoscaler) step(backlog int, latency time.Duration) int {
+	min, max := a.Min.Load(), a.Max.Load()
+	if max < min {
+		max = min
+	}
+
+	size := a.Pool.Size()
+	n := size
+	perWorker := autoscaleBacklog.Load()
+
+	switch {
+	case latency > time.Duration(autoscaleLatency.Load())*time.Millisecond:
+		n--
+	case perWorker > 0 && backlog > n*perWorker:
+		// Grow quickly, up to the number of workers needed for the backlog
+		if n *= 2; n == 0 {
+			n = 1
+		}
+		if needed := (backlog + perWorker - 1) / perWorker; n > needed {
+			n = needed
+		}
+	case backlog == 0:
+		n--
+	}
+
+	if n < min {
+		n = min
+	}
+	if n > max {
+		n = max
+	}
+
+	if n != size {
+		autoscaleLog.Debug("Resizing worker pool", "workers", n, "old", size, "backlog", backlog, "latency", latency)
+		a.Pool.Resize(n)
+	}
+	return n
+}
+
+// Run resizes the pool every autoscaleInterval.
+func (a *Autoscaler) Run() {
+	ticker := time.NewTicker(autoscaleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.step(a.Backlog(), a.Latency.reset())
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendLatency(t *testing.T) {
+	l := &sendLatency{}
+	assertEquals(t, l.reset(), time.Duration(0))
+
+	l.observe(10 * time.Millisecond)
+	l.observe(30 * time.Millisecond)
+	assertEquals(t, l.reset(), 20*time.Millisecond)
+	assertEquals(t, l.reset(), time.Duration(0))
+}
+
+func TestAutoscaler(t *testing.T) {
+	min, max := &atomicInt{}, &atomicInt{}
+	min.Set("2")
+	max.Set("10")
+
+	pool := NewWorkerPool(2, func(quit chan struct{}) {
+		<-quit
+	})
+	defer pool.Resize(0)
+	a := &Autoscaler{Pool: pool, Min: min, Max: max}
+
+	// Nothing to do
+	assertEquals(t, a.step(150, 10*time.Millisecond), 2)
+
+	// Double, up to the workers needed for the backlog
+	assertEquals(t, a.step(350, 10*time.Millisecond), 4)
+	assertEquals(t, a.step(450, 10*time.Millisecond), 5)
+	assertEquals(t, pool.Size(), 5)
+
+	// Not above the maximum
+	assertEquals(t, a.step(100000, 10*time.Millisecond), 10)
+	assertEquals(t, a.step(100000, 10*time.Millisecond), 10)
+
+	// The cache is slow
+	assertEquals(t, a.step(100000, time.Second), 9)
+
+	// Shrink once idle, not below the minimum
+	assertEquals(t, a.step(0, 0), 8)
+	for i := 0; i < 10; i++ {
+		a.step(0, 0)
+	}
+	assertEquals(t, pool.Size(), 2)
+
+	// The bounds changed
+	min.Set("3")
+	assertEquals(t, a.step(0, 0), 3)
+}
@@ -0,0 +1,207 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	banKind = "ban"
+
+	// Varnish is expected to pass the content of this header to ban()
+	banHeader = "X-Ban-Expression"
+
+	varnishValue = "varnish"
+	atsValue     = "ats"
+)
+
+var bans = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "purged_bans_total",
+	Help: "Total number of BAN and regex invalidations sent by status",
+}, []string{
+	statusLabel,
+	layerLabel,
+})
+
+// BanGuard restricts which hosts and patterns may be banned. Patterns must be
+// anchored to the beginning of the path and start with a literal prefix of at
+// least MinPrefix characters, without top-level alternations, so that a
+// single ban cannot invalidate a whole site.
+type BanGuard struct {
+	Hosts     *regexp.Regexp
+	MinPrefix int
+}
+
+// literalPrefix returns the case sensitive literal text any path matched by
+// pattern starts with, or an empty string if pattern is not anchored with ^
+// or is a top-level alternation.
+func literalPrefix(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat || len(re.Sub) < 2 {
+		return ""
+	}
+
+	if re.Sub[0].Op != syntax.OpBeginText || re.Sub[1].Op != syntax.OpLiteral || re.Sub[1].Flags&syntax.FoldCase != 0 {
+		return ""
+	}
+	return string(re.Sub[1].Rune)
+}
+
+// anchorPattern returns pattern, starting with ^, as a group to be appended
+// to the regex matching the beginning of the URL or path, so that any
+// alternation it contains stays anchored.
+func anchorPattern(pattern string) string {
+	return "(?:" + strings.TrimPrefix(pattern, "^") + ")"
+}
+
+// Check returns an error if banning pattern on host is not allowed.
+func (g *BanGuard) Check(host, pattern string) error {
+	if g == nil || g.Hosts == nil {
+		return errors.New("Bans are disabled")
+	}
+
+	if !g.Hosts.MatchString(host) {
+		return fmt.Errorf("Bans are not allowed for host %s", host)
+	}
+
+	if !strings.HasPrefix(pattern, "^/") {
+		return fmt.Errorf("Ban pattern %q must start with ^/", pattern)
+	}
+
+	if strings.ContainsAny(pattern, " \t\r\n") {
+		return fmt.Errorf("Ban pattern %q must not contain whitespace", pattern)
+	}
+
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return err
+	}
+
+	if re.Op == syntax.OpAlternate {
+		return fmt.Errorf("Ban pattern %q must not be a top-level alternation", pattern)
+	}
+
+	if literalPrefix(pattern) == "" {
+		return fmt.Errorf("Ban pattern %q must start with ^ followed by a literal", pattern)
+	}
+
+	if len(literalPrefix(pattern)) < g.MinPrefix {
+		return fmt.Errorf("Ban pattern %q must start with at least %d literal characters", pattern, g.MinPrefix)
+	}
+
+	return nil
+}
+
+// banExpression returns the Varnish ban expression invalidating the objects of
+// host with a path matching pattern. The expression only refers to obj.*
+// variables so that it can be processed by the ban lurker: x-host and x-url
+// need to be set on the object in vcl_backend_response.
+func banExpression(host, pattern string) string {
+	return fmt.Sprintf("obj.http.x-host == %s && obj.http.x-url ~ ^%s", host, anchorPattern(pattern))
+}
+
+// ATSRevalidator is a PurgeClient for Apache Traffic Server. Exact purges are
+// sent with the wrapped PurgeClient, while bans are written as rules to the
+// configuration file of the regex_revalidate plugin.
+type ATSRevalidator struct {
+	PurgeClient
+	configFile string
+	ttl        time.Duration
+}
+
+// SendRequest sends exact purges according to the RequestTemplate of the
+// wrapped PurgeClient, if any.
+func (p *ATSRevalidator) SendRequest(r PurgeRequest) (string, error) {
+	if rc, ok := p.PurgeClient.(RequestPurgeClient); ok {
+		return rc.SendRequest(r)
+	}
+	return p.Send(r.Host, r.URI)
+}
+
+// regex_revalidate configuration is shared by all workers
+var revalidateMutex sync.Mutex
+
+func NewATSRevalidator(client PurgeClient, configFile string, ttl time.Duration) *ATSRevalidator {
+	return &ATSRevalidator{PurgeClient: client, configFile: configFile, ttl: ttl}
+}
+
+// Ban adds a rule to the regex_revalidate configuration, pruning expired
+// ones. The rule regex is matched by ATS against the full URL.
+func (p *ATSRevalidator) Ban(host, pattern string) (string, error) {
+	if p.configFile == "" {
+		return "", errors.New("No regex_revalidate configuration file specified")
+	}
+
+	revalidateMutex.Lock()
+	defer revalidateMutex.Unlock()
+
+	now := time.Now()
+	var rules []string
+
+	f, err := os.Open(p.configFile)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "#") {
+				rules = append(rules, scanner.Text())
+				continue
+			}
+
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+
+			expiry, err := strconv.ParseInt(fields[1], 10, 64)
+			if err == nil && expiry > now.Unix() {
+				rules = append(rules, scanner.Text())
+			}
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	rule := fmt.Sprintf("^https?://%s%s %d", regexp.QuoteMeta(host), anchorPattern(pattern), now.Add(p.ttl).Unix())
+	rules = append(rules, rule)
+
+	// Write and rename, so that ATS never reads a partial file
+	data := []byte(strings.Join(rules, "\n") + "\n")
+	if err := ioutil.WriteFile(p.configFile+".tmp", data, 0644); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(p.configFile+".tmp", p.configFile); err != nil {
+		return "", err
+	}
+
+	return "ok", nil
+}
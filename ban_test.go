@@ -0,0 +1,115 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLiteralPrefix(t *testing.T) {
+	assertEquals(t, literalPrefix("^/wikipedia/commons/thumb/7/78/"), "/wikipedia/commons/thumb/7/78/")
+	assertEquals(t, literalPrefix("^/wiki/.*"), "/wiki/")
+	assertEquals(t, literalPrefix("^/w(iki)?/"), "/w")
+	assertEquals(t, literalPrefix("^/wiki/Foobarxx|.*"), "")
+	assertEquals(t, literalPrefix("/wiki/"), "")
+	assertEquals(t, literalPrefix("(?i)^/wiki/"), "")
+}
+
+func TestBanGuard(t *testing.T) {
+	var guard *BanGuard
+	expectErr(t, guard.Check("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/"))
+
+	guard = &BanGuard{Hosts: regexp.MustCompile(`^upload\.wikimedia\.org$`), MinPrefix: 10}
+	assertNotErr(t, guard.Check("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/"))
+
+	// Host not allowed
+	expectErr(t, guard.Check("en.wikipedia.org", "^/wikipedia/commons/thumb/7/78/"))
+	// Not anchored
+	expectErr(t, guard.Check("upload.wikimedia.org", "/wikipedia/commons/thumb/7/78/"))
+	// Too broad
+	expectErr(t, guard.Check("upload.wikimedia.org", "^/wiki.*"))
+	// Invalid regex
+	expectErr(t, guard.Check("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/("))
+	// Top-level alternations match anything
+	expectErr(t, guard.Check("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/|.*"))
+	// Case insensitive prefix
+	expectErr(t, guard.Check("upload.wikimedia.org", "(?i)^/wikipedia/commons/thumb/7/78/"))
+	// Whitespace would break regex_revalidate rules
+	expectErr(t, guard.Check("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/ 0"))
+}
+
+func TestSendBan(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assertEquals(t, req.URL.String(), "/")
+		assertEquals(t, req.Method, "BAN")
+		assertEquals(t, req.Host, "upload.wikimedia.org")
+		assertEquals(t, req.Header.Get(banHeader), "obj.http.x-host == upload.wikimedia.org && obj.http.x-url ~ ^(?:/wikipedia/commons/thumb/7/78/)")
+		rw.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+	parsedURL, _ := url.Parse(server.URL)
+
+	tcpClient := NewTCPPurger(parsedURL.Host)
+	status, err := tcpClient.Ban("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/")
+	assertEquals(t, status, "200")
+	assertEquals(t, err, nil)
+
+	httpClient := NewHTTPPurger(parsedURL.Host, httpPurgerOptions)
+	status, err = httpClient.Ban("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/")
+	assertEquals(t, status, "200")
+	assertEquals(t, err, nil)
+}
+
+func TestATSRevalidatorBan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-ats")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "regex_revalidate.config")
+	expired := fmt.Sprintf("^https?://upload\\.wikimedia\\.org/wikipedia/commons/a/ %d", time.Now().Add(-time.Hour).Unix())
+	ioutil.WriteFile(configFile, []byte("# managed by purged\n"+expired+"\n"), 0644)
+
+	client := NewATSRevalidator(nil, configFile, time.Hour)
+	status, err := client.Ban("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/")
+	assertNotErr(t, err)
+	assertEquals(t, status, "ok")
+
+	data, _ := ioutil.ReadFile(configFile)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assertEquals(t, len(lines), 2)
+	assertEquals(t, lines[0], "# managed by purged")
+	assertEquals(t, strings.Fields(lines[1])[0], "^https?://upload\\.wikimedia\\.org(?:/wikipedia/commons/thumb/7/78/)")
+
+	// Alternations stay anchored to the host
+	rule := regexp.MustCompile(strings.Fields(lines[1])[0])
+	assertEquals(t, rule.MatchString("https://upload.wikimedia.org/wikipedia/commons/thumb/7/78/a.png"), true)
+	assertEquals(t, rule.MatchString("https://en.wikipedia.org/wiki/Main_Page"), false)
+
+	// Without a configuration file, bans cannot be sent
+	_, err = NewATSRevalidator(nil, "", time.Hour).Ban("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/")
+	expectErr(t, err)
+}
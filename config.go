@@ -0,0 +1,339 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// How often to check whether the configuration file changed
+const configPollInterval = 5 * time.Second
+
+var configLog = NewLogger("config")
+
+// Settings holding secrets, never disclosed
+var secretSettings = map[string]bool{
+	"admin_token":            true,
+	"backend_purge_headers":  true,
+	"frontend_purge_headers": true,
+}
+
+// redact returns the value of the given setting, or a placeholder if it is
+// a non-empty secret.
+func redact(name, value string) string {
+	if secretSettings[name] && value != "" {
+		return "<redacted>"
+	}
+	return value
+}
+
+// atomicInt is an int flag which can be changed at runtime.
+type atomicInt struct {
+	v int64
+}
+
+func atomicIntFlag(name string, value int, usage string) *atomicInt {
+	i := &atomicInt{v: int64(value)}
+	flag.Var(i, name, usage)
+	return i
+}
+
+func (i *atomicInt) Load() int {
+	return int(atomic.LoadInt64(&i.v))
+}
+
+func (i *atomicInt) String() string {
+	return strconv.Itoa(i.Load())
+}
+
+func (i *atomicInt) Set(s string) error {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&i.v, int64(v))
+	return nil
+}
+
+// atomicFloat is a float64 flag which can be changed at runtime.
+type atomicFloat struct {
+	bits uint64
+}
+
+func atomicFloatFlag(name string, value float64, usage string) *atomicFloat {
+	f := &atomicFloat{bits: math.Float64bits(value)}
+	flag.Var(f, name, usage)
+	return f
+}
+
+func (f *atomicFloat) Load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func (f *atomicFloat) String() string {
+	return strconv.FormatFloat(f.Load(), 'g', -1, 64)
+}
+
+func (f *atomicFloat) Set(s string) error {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+	return nil
+}
+
+// atomicString is a string flag which can be changed at runtime.
+type atomicString struct {
+	v atomic.Value
+}
+
+func atomicStringFlag(name string, value string, usage string) *atomicString {
+	s := &atomicString{}
+	s.v.Store(value)
+	flag.Var(s, name, usage)
+	return s
+}
+
+func (s *atomicString) Load() string {
+	v, _ := s.v.Load().(string)
+	return v
+}
+
+func (s *atomicString) String() string {
+	return s.Load()
+}
+
+func (s *atomicString) Set(v string) error {
+	s.v.Store(v)
+	return nil
+}
+
+// parseConfigFile reads a YAML file mapping flag names to their values.
+// Lists are turned into comma separated values.
+func parseConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("Unknown setting %s in %s", name, path)
+		}
+
+		switch v := value.(type) {
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("Invalid value for %s in %s", name, path)
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+
+	return values, nil
+}
+
+// Config applies the settings of a configuration file to the flags. Flags
+// given on the command line take precedence over the file. On reload, only
+// the settings registered with Live are changed, the others requiring a
+// restart.
+type Config struct {
+	mutex   sync.Mutex
+	path    string
+	mtime   time.Time
+	cmdline map[string]bool
+	live    map[string]func() error
+}
+
+// cmdlineFlags returns the names of the flags given on the command line. It
+// must be called right after flag.Parse.
+func cmdlineFlags() map[string]bool {
+	cmdline := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		cmdline[f.Name] = true
+	})
+	return cmdline
+}
+
+// NewConfig returns the Config for the file at path, leaving the flags in
+// cmdline untouched.
+func NewConfig(path string, cmdline map[string]bool) *Config {
+	return &Config{path: path, cmdline: cmdline, live: make(map[string]func() error)}
+}
+
+// Live registers a setting which can be changed at runtime. apply, if not
+// nil, is called once the flag has been set to its new value.
+func (c *Config) Live(name string, apply func() error) {
+	c.mutex.Lock()
+	c.live[name] = apply
+	c.mutex.Unlock()
+}
+
+// changes returns the flags whose value differs from the file, sorted by
+// name. Flags not in the file are reset to their default value.
+func (c *Config) changes() (map[string]string, []string, error) {
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mtime = fi.ModTime()
+
+	values, err := parseConfigFile(c.path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) {
+		if c.cmdline[f.Name] || f.Name == "config" {
+			return
+		}
+
+		value, ok := values[f.Name]
+		if !ok {
+			value = f.DefValue
+			values[f.Name] = value
+		}
+
+		if value != f.Value.String() {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+
+	return values, names, nil
+}
+
+// Load sets all flags to the values in the configuration file.
+func (c *Config) Load() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	values, names, err := c.changes()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := flag.Set(name, values[name]); err != nil {
+			return fmt.Errorf("Invalid value %q for %s: %v", values[name], name, err)
+		}
+	}
+
+	configLog.Info("Loaded configuration", "file", c.path)
+	return nil
+}
+
+// Reload applies the settings which changed in the configuration file and
+// can be changed at runtime, logging those requiring a restart.
+func (c *Config) Reload() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	values, names, err := c.changes()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		// Do not disclose secrets in the logs, nor in the errors mentioning them
+		value := redact(name, values[name])
+
+		apply, ok := c.live[name]
+		if !ok {
+			configLog.Warn("Setting changed, restart required", "setting", name, "value", value)
+			continue
+		}
+
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, values[name]); err != nil {
+			configLog.Error("Invalid value", "setting", name, "value", value, "err", redact(name, err.Error()))
+			continue
+		}
+
+		if apply != nil {
+			if err := apply(); err != nil {
+				configLog.Error("Invalid value", "setting", name, "value", value, "err", redact(name, err.Error()))
+				flag.Set(name, old)
+				continue
+			}
+		}
+
+		configLog.Info("Setting changed", "setting", name, "value", value, "old", redact(name, old))
+	}
+
+	return nil
+}
+
+// modified returns true if the configuration file changed since it was last
+// read.
+func (c *Config) modified() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fi, err := os.Stat(c.path)
+	return err == nil && !fi.ModTime().Equal(c.mtime)
+}
+
+// Watch reloads the configuration on SIGHUP, received on hup, and when the
+// file is modified.
+func (c *Config) Watch(hup chan os.Signal) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			configLog.Info("Reloading configuration on SIGHUP", "file", c.path)
+		case <-ticker.C:
+			if !c.modified() {
+				continue
+			}
+			configLog.Info("Reloading configuration, file modified", "file", c.path)
+		}
+
+		if err := c.Reload(); err != nil {
+			configLog.Error("Error reloading configuration", "file", c.path, "err", err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupConfigTest(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "purged-config")
+	assertNotErr(t, err)
+
+	path := filepath.Join(dir, "purged.yaml")
+	assertNotErr(t, ioutil.WriteFile(path, []byte(content), 0644))
+
+	return path, func() {
+		os.RemoveAll(dir)
+		flag.VisitAll(func(f *flag.Flag) {
+			if !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+		})
+	}
+}
+
+// testFlags returns the flags of the testing package, which must not be reset
+// to their default value
+func testFlags() map[string]bool {
+	names := make(map[string]bool)
+	flag.VisitAll(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "test.") {
+			names[f.Name] = true
+		}
+	})
+	return names
+}
+
+func TestParseConfigFile(t *testing.T) {
+	path, cleanup := setupConfigTest(t, `
+mcast_addrs: [239.128.0.112, 239.128.0.113]
+frontend_delay: 500
+nethttp: true
+host_regex: '\.wikipedia\.org$'
+`)
+	defer cleanup()
+
+	values, err := parseConfigFile(path)
+	assertNotErr(t, err)
+	assertEquals(t, values["mcast_addrs"], "239.128.0.112,239.128.0.113")
+	assertEquals(t, values["frontend_delay"], "500")
+	assertEquals(t, values["nethttp"], "true")
+	assertEquals(t, values["host_regex"], `\.wikipedia\.org$`)
+
+	ioutil.WriteFile(path, []byte("backend_workerz: 4\n"), 0644)
+	_, err = parseConfigFile(path)
+	expectErr(t, err)
+
+	ioutil.WriteFile(path, []byte("backend_workers: [\n"), 0644)
+	_, err = parseConfigFile(path)
+	expectErr(t, err)
+}
+
+func TestConfigLoad(t *testing.T) {
+	path, cleanup := setupConfigTest(t, "frontend_delay: 500\nbackend_workers: 8\n")
+	defer cleanup()
+
+	c := NewConfig(path, testFlags())
+	assertNotErr(t, c.Load())
+	assertEquals(t, frontendDelay.Load(), 500)
+	assertEquals(t, nBackendWorkers.Load(), 8)
+
+	ioutil.WriteFile(path, []byte("frontend_delay: soon\n"), 0644)
+	expectErr(t, NewConfig(path, testFlags()).Load())
+}
+
+func TestConfigReload(t *testing.T) {
+	path, cleanup := setupConfigTest(t, "frontend_delay: 500\nmcast_addrs: 239.128.0.112\nbackend_workers: 8\n")
+	defer cleanup()
+
+	c := NewConfig(path, testFlags())
+	assertNotErr(t, c.Load())
+
+	applied := 0
+	c.Live("frontend_delay", nil)
+	c.Live("backend_workers", func() error {
+		applied++
+		if nBackendWorkers.Load() <= 0 {
+			return errors.New("At least one worker is needed")
+		}
+		return nil
+	})
+
+	ioutil.WriteFile(path, []byte("frontend_delay: 200\nmcast_addrs: 239.128.0.113\nbackend_workers: 2\n"), 0644)
+	assertEquals(t, c.modified(), true)
+	assertNotErr(t, c.Reload())
+	assertEquals(t, c.modified(), false)
+
+	assertEquals(t, frontendDelay.Load(), 200)
+	assertEquals(t, nBackendWorkers.Load(), 2)
+	assertEquals(t, applied, 1)
+	// Requires a restart
+	assertEquals(t, *mcastAddrs, "239.128.0.112")
+
+	// Invalid values are not applied
+	ioutil.WriteFile(path, []byte("frontend_delay: 200\nmcast_addrs: 239.128.0.112\nbackend_workers: 0\n"), 0644)
+	assertNotErr(t, c.Reload())
+	assertEquals(t, nBackendWorkers.Load(), 2)
+
+	// Settings removed from the file are reset to their default
+	ioutil.WriteFile(path, []byte("mcast_addrs: 239.128.0.112\n"), 0644)
+	assertNotErr(t, c.Reload())
+	assertEquals(t, frontendDelay.Load(), 1000)
+	assertEquals(t, nBackendWorkers.Load(), 4)
+}
+
+func TestWorkerPool(t *testing.T) {
+	running := make(chan int, 10)
+	p := NewWorkerPool(3, func(quit chan struct{}) {
+		running <- 1
+		<-quit
+		running <- -1
+	})
+
+	total := 0
+	for i := 0; i < 3; i++ {
+		total += <-running
+	}
+	assertEquals(t, total, 3)
+
+	p.Resize(1)
+	for i := 0; i < 2; i++ {
+		total += <-running
+	}
+	assertEquals(t, total, 1)
+	assertEquals(t, p.Size(), 1)
+}
+
+func TestRedact(t *testing.T) {
+	assertEquals(t, redact("admin_token", "secret"), "<redacted>")
+	assertEquals(t, redact("frontend_purge_headers", "X-Purge-Token:secret"), "<redacted>")
+	assertEquals(t, redact("frontend_purge_headers", ""), "")
+	assertEquals(t, redact("backend_addr", "127.0.0.1:3128"), "127.0.0.1:3128")
+}
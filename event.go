@@ -19,14 +19,17 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // The json schema for resource_change messages can be found at
 // https://schema.wikimedia.org/repositories/primary/jsonschema/resource_change/1.0.0.json
 // We only ingest data that we currently use or that we expect to use in the future.
 
+var timestampErrorLog = kafkaLog.Limited()
+
 // RcTime is a simple container for time objects coming from the wire.
 // Using such a struct allows us to implement json unmarshalling.
 type RcTime struct {
@@ -44,7 +47,7 @@ func (t *RcTime) UnmarshalJSON(b []byte) (err error) {
 		t.Time = parsed
 	} else {
 		// we don't want to fail if we get an invalid date format. We'd rather log it.
-		log.Printf("Invalid timestamp found: %s", data)
+		timestampErrorLog.Warn("Invalid timestamp found", "timestamp", data)
 		t.Time = time.Now()
 	}
 	// So, we never fail unmarshalling dates, because it's auxillary information.
@@ -58,6 +61,15 @@ type RcEvent struct {
 
 	// Unique URI identifying the event or entity
 	URI *string `json:"uri"`
+
+	// Unique ID of this event
+	ID string `json:"id,omitempty"`
+
+	// Unique ID of the request that caused the event
+	RequestID string `json:"request_id,omitempty"`
+
+	// Domain the event or entity pertain to
+	Domain string `json:"domain,omitempty"`
 }
 
 // RcRootEvent is the Unique identifier of the root event that triggered this event creation
@@ -76,6 +88,14 @@ type ResourceChange struct {
 
 	// the list of tags associated with the change event for the resource
 	Tags []string `json:"tags,omitempty"`
+
+	// Optional regex matched against the path of the objects to invalidate
+	// on the host of meta.uri. Not part of the resource_change schema.
+	Ban string `json:"ban,omitempty"`
+
+	// Optional surrogate keys of the objects to invalidate, on the host of
+	// meta.uri or on meta.domain. Not part of the resource_change schema.
+	Keys []string `json:"surrogate_keys,omitempty"`
 }
 
 // NewResourceChangeFromJSON returns a resource change object from Json
@@ -84,15 +104,41 @@ func NewResourceChangeFromJSON(data *[]byte) (*ResourceChange, error) {
 	if err := json.Unmarshal(*data, &rc); err != nil {
 		return nil, err
 	}
-	// We don't want objects without an url.
-	if rc.Event.URI == nil {
+	// We don't want objects without an url, unless they carry surrogate keys
+	// and a domain to purge them on.
+	if rc.Event.URI == nil && (len(rc.Keys) == 0 || rc.Event.Domain == "") {
 		return nil, fmt.Errorf("The message didn't contain a valid URL")
 	}
+	// Keys are sent in a header, separated by spaces
+	for _, key := range rc.Keys {
+		if err := checkSurrogateKey(key); err != nil {
+			return nil, err
+		}
+	}
 	return &rc, nil
 }
 
-// GetURL returns the url of the event
+// checkSurrogateKey returns an error if key cannot be sent in a header
+// listing surrogate keys.
+func checkSurrogateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("Empty surrogate key")
+	}
+	if strings.IndexFunc(key, func(r rune) bool {
+		return unicode.IsControl(r) || unicode.IsSpace(r) || r == ','
+	}) != -1 {
+		return fmt.Errorf("Invalid surrogate key %q", key)
+	}
+	return nil
+}
+
+// GetURL returns the url of the event. For surrogate key purges without a
+// URI, that is the root of the event domain.
 func (rc *ResourceChange) GetURL() *string {
+	if rc.Event.URI == nil {
+		root := "https://" + rc.Event.Domain + "/"
+		return &root
+	}
 	return rc.Event.URI
 }
 
@@ -129,3 +129,57 @@ func BenchmarkDecodeResourceChange(b *testing.B) {
 		rc.GetURL()
 	}
 }
+
+// Events carrying surrogate keys do not need a URI, as long as they have a
+// domain
+func TestNewResourceChangeFromJSONKeys(t *testing.T) {
+	eventData := []byte(`{
+		"$schema": "/resource_change/1.0.0",
+		"meta": {
+			"dt": "2020-04-30T11:37:53Z",
+			"stream": "purge",
+			"domain": "en.wikipedia.org"
+		},
+		"surrogate_keys": ["page:123", "page:456"]
+	}`)
+	event, err := NewResourceChangeFromJSON(&eventData)
+	if err != nil {
+		t.Fatalf("Error loading event: %v", err)
+	}
+	if len(event.Keys) != 2 || event.Keys[1] != "page:456" {
+		t.Errorf("Unexpected keys %v", event.Keys)
+	}
+	if *event.GetURL() != "https://en.wikipedia.org/" {
+		t.Errorf("The url found in the event is %s (https://en.wikipedia.org/) expected", *event.GetURL())
+	}
+
+	// Without a domain, there is nothing to purge the keys on
+	eventData = []byte(`{
+		"meta": {"dt": "2020-04-30T11:37:53Z", "stream": "purge"},
+		"surrogate_keys": ["page:123"]
+	}`)
+	_, err = NewResourceChangeFromJSON(&eventData)
+	if err == nil {
+		t.Errorf("No error returned when loading an event without a URL or domain")
+	}
+}
+
+// Keys which could inject headers or requests are rejected
+func TestNewResourceChangeFromJSONBadKeys(t *testing.T) {
+	for _, keys := range []string{
+		`[""]`,
+		`["page:123", "page:456\r\nX-Injected: 1"]`,
+		`["page:123\r\n\r\nPURGE / HTTP/1.1"]`,
+		`["page:123 page:456"]`,
+		`["page:123,page:456"]`,
+		`["page:\u0000123"]`,
+	} {
+		eventData := []byte(`{
+			"meta": {"dt": "2020-04-30T11:37:53Z", "domain": "en.wikipedia.org"},
+			"surrogate_keys": ` + keys + `
+		}`)
+		if _, err := NewResourceChangeFromJSON(&eventData); err == nil {
+			t.Errorf("No error returned when loading an event with keys %s", keys)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	okStatus   = "ok"
+	failStatus = "fail"
+)
+
+// ReaderStatus tracks whether a reader is still running.
+type ReaderStatus struct {
+	mutex   sync.Mutex
+	name    string
+	running bool
+	since   time.Time
+	// stop asks the reader to stop, finished is closed once it did
+	stop     func()
+	finished chan struct{}
+}
+
+var (
+	readersMutex sync.Mutex
+	readers      []*ReaderStatus
+)
+
+// registerReader returns the ReaderStatus of a new running reader, which is
+// stopped on shutdown by calling stop.
+func registerReader(name string, stop func()) *ReaderStatus {
+	status := &ReaderStatus{name: name, running: true, since: time.Now(), stop: stop, finished: make(chan struct{})}
+
+	readersMutex.Lock()
+	readers = append(readers, status)
+	readersMutex.Unlock()
+
+	return status
+}
+
+// stopped records that the reader is not running anymore.
+func (s *ReaderStatus) stopped() {
+	s.mutex.Lock()
+	s.running = false
+	s.since = time.Now()
+	s.mutex.Unlock()
+	close(s.finished)
+}
+
+func (s *ReaderStatus) check() ComponentStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return ComponentStatus{Name: "reader/" + s.name, Status: failStatus, Detail: fmt.Sprintf("stopped at %s", s.since.Format(time.RFC3339))}
+	}
+	return ComponentStatus{Name: "reader/" + s.name, Status: okStatus}
+}
+
+// ComponentStatus is the health of a single pipeline component.
+type ComponentStatus struct {
+	Name   string
+	Status string
+	Detail string `json:",omitempty"`
+}
+
+// HealthReport is the health of all components. Status is failStatus if
+// any component failed.
+type HealthReport struct {
+	Status     string
+	Components []ComponentStatus
+}
+
+func (r *HealthReport) add(c ComponentStatus) {
+	if c.Status != okStatus {
+		r.Status = failStatus
+	}
+	r.Components = append(r.Components, c)
+}
+
+// Health checks the state of the purge pipeline. Liveness requires all
+// readers to be running and each worker pool to have at least one worker
+// not stuck sending a purge for longer than WorkerTimeout. Readiness also
+// requires all destinations to be connected and the backlogs not to exceed
+// MaxBacklog. The backend backlog includes the purges in Spool, if any.
+type Health struct {
+	Queue         *PriorityQueue
+	Spool         *PrioritySpool
+	ChFrontend    chan Purge
+	MaxBacklog    int
+	WorkerTimeout time.Duration
+}
+
+// workerPools returns the status of the backend and frontend worker pools.
+func (h *Health) workerPools(snapshots []WorkerInfo, now time.Time) []ComponentStatus {
+	total := make(map[string]int)
+	stuck := make(map[string]int)
+
+	for _, w := range snapshots {
+		total[w.Layer]++
+		if w.State == sendingState && now.Sub(w.Since) > h.WorkerTimeout {
+			stuck[w.Layer]++
+		}
+	}
+
+	var statuses []ComponentStatus
+	for _, layer := range []string{backendValue, frontendValue} {
+		c := ComponentStatus{Name: "workers/" + layer, Status: okStatus}
+		if total[layer] == 0 || stuck[layer] == total[layer] {
+			c.Status = failStatus
+		}
+		if stuck[layer] > 0 {
+			c.Detail = fmt.Sprintf("%d of %d workers stuck for more than %s", stuck[layer], total[layer], h.WorkerTimeout)
+		}
+		statuses = append(statuses, c)
+	}
+
+	return statuses
+}
+
+// backlogs returns the status of the backend and frontend backlogs.
+func (h *Health) backlogs() []ComponentStatus {
+	backend := h.Queue.Pending()
+	if h.Spool != nil {
+		backend += int(h.Spool.Len())
+	}
+
+	var statuses []ComponentStatus
+	for _, layer := range []string{backendValue, frontendValue} {
+		n := backend
+		if layer == frontendValue {
+			n = len(h.ChFrontend)
+		}
+
+		c := ComponentStatus{Name: "backlog/" + layer, Status: okStatus, Detail: fmt.Sprintf("%d purges", n)}
+		if h.MaxBacklog > 0 && n > h.MaxBacklog {
+			c.Status = failStatus
+		}
+		statuses = append(statuses, c)
+	}
+
+	return statuses
+}
+
+// Check returns the liveness report, or the readiness one if ready is true.
+func (h *Health) Check(ready bool, now time.Time) HealthReport {
+	report := HealthReport{Status: okStatus}
+
+	readersMutex.Lock()
+	for _, reader := range readers {
+		report.add(reader.check())
+	}
+	readersMutex.Unlock()
+
+	snapshots := workerSnapshots()
+	for _, c := range h.workerPools(snapshots, now) {
+		report.add(c)
+	}
+
+	if !ready {
+		return report
+	}
+
+	for _, d := range destinationStatuses(snapshots) {
+		c := ComponentStatus{Name: "destination/" + d.Layer + "/" + d.Addr, Status: okStatus}
+		if !d.Connected {
+			c.Status = failStatus
+			c.Detail = d.LastError
+		}
+		report.add(c)
+	}
+
+	for _, c := range h.backlogs() {
+		report.add(c)
+	}
+
+	return report
+}
+
+func (h *Health) handler(ready bool) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		report := h.Check(ready, time.Now())
+
+		rw.Header().Set("Content-Type", "application/json")
+		if report.Status != okStatus {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+		writeJSON(rw, report)
+	}
+}
+
+// LivenessHandler serves /healthz.
+func (h *Health) LivenessHandler() http.HandlerFunc {
+	return h.handler(false)
+}
+
+// ReadinessHandler serves /readyz.
+func (h *Health) ReadinessHandler() http.HandlerFunc {
+	return h.handler(true)
+}
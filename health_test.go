@@ -0,0 +1,123 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func setupHealthTest(t *testing.T, maxBacklog int) *Health {
+	queue, err := NewPriorityQueue("normal:1", "", "normal", 10)
+	assertNotErr(t, err)
+
+	return &Health{
+		Queue:         queue,
+		ChFrontend:    make(chan Purge, 10),
+		MaxBacklog:    maxBacklog,
+		WorkerTimeout: time.Minute,
+	}
+}
+
+func TestHealthWorkerPools(t *testing.T) {
+	h := setupHealthTest(t, 0)
+	now := time.Now()
+
+	statuses := h.workerPools([]WorkerInfo{
+		{Layer: backendValue, State: sendingState, Since: now.Add(-time.Hour)},
+		{Layer: backendValue, State: idleState, Since: now.Add(-time.Hour)},
+		{Layer: frontendValue, State: sendingState, Since: now.Add(-time.Hour)},
+	}, now)
+
+	assertEquals(t, statuses[0].Name, "workers/backend")
+	assertEquals(t, statuses[0].Status, okStatus)
+	assertEquals(t, statuses[0].Detail, "1 of 2 workers stuck for more than 1m0s")
+	// All frontend workers are stuck
+	assertEquals(t, statuses[1].Status, failStatus)
+
+	// No workers at all
+	statuses = h.workerPools(nil, now)
+	assertEquals(t, statuses[0].Status, failStatus)
+}
+
+func TestHealthBacklogs(t *testing.T) {
+	h := setupHealthTest(t, 1)
+	h.Queue.Push(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"})
+	h.ChFrontend <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+	h.ChFrontend <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+
+	statuses := h.backlogs()
+	assertEquals(t, statuses[0].Name, "backlog/backend")
+	assertEquals(t, statuses[0].Status, okStatus)
+	assertEquals(t, statuses[1].Name, "backlog/frontend")
+	assertEquals(t, statuses[1].Status, failStatus)
+}
+
+// With a spool, most of the backend backlog is on disk
+func TestHealthBacklogSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-spool")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	h := setupHealthTest(t, 1)
+	h.Spool, err = NewPrioritySpool(dir, 1<<20, 1<<10, spoolBlock, h.Queue)
+	assertNotErr(t, err)
+	defer h.Spool.Close()
+
+	assertNotErr(t, h.Spool.PutPurge(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}))
+	assertEquals(t, h.backlogs()[0].Status, okStatus)
+
+	assertNotErr(t, h.Spool.PutPurge(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}))
+	statuses := h.backlogs()
+	assertEquals(t, statuses[0].Status, failStatus)
+	assertEquals(t, statuses[0].Detail, "2 purges")
+}
+
+func TestHealthReaders(t *testing.T) {
+	saved := readers
+	readers = nil
+	defer func() { readers = saved }()
+
+	h := setupHealthTest(t, 0)
+	status := registerReader(kafkaValue, nil)
+
+	components := func() map[string]ComponentStatus {
+		byName := make(map[string]ComponentStatus)
+		for _, c := range h.Check(false, time.Now()).Components {
+			byName[c.Name] = c
+		}
+		return byName
+	}
+
+	assertEquals(t, components()["reader/kafka"].Status, okStatus)
+
+	status.stopped()
+	assertEquals(t, components()["reader/kafka"].Status, failStatus)
+
+	rw := httptest.NewRecorder()
+	h.LivenessHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/healthz", nil))
+	assertEquals(t, rw.Code, http.StatusServiceUnavailable)
+
+	var report HealthReport
+	assertNotErr(t, json.Unmarshal(rw.Body.Bytes(), &report))
+	assertEquals(t, report.Status, failStatus)
+}
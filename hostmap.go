@@ -0,0 +1,104 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+type hostMapping struct {
+	re        *regexp.Regexp
+	templates []string
+}
+
+// HostMap maps the hostname of purges to the Host headers sent to a cache
+// layer, for caches keying objects on internal hostnames. It can be changed
+// at runtime. A nil or empty HostMap sends the hostname of the purge as is.
+type HostMap struct {
+	mappings atomic.Value
+}
+
+// Host headers sent to each cache layer
+var hostMaps = map[string]*HostMap{
+	backendValue:  {},
+	frontendValue: {},
+}
+
+// parseHostMap parses a comma separated list of regex=hosts pairs, with hosts
+// separated by |. Hosts can refer to the groups of regex, which must match
+// the whole hostname, eg:
+// ^upload\.wikimedia\.org$=upload.wikimedia.org|upload-lb.wikimedia.org
+func parseHostMap(s string) ([]hostMapping, error) {
+	var mappings []hostMapping
+
+	for _, item := range strings.Split(s, ",") {
+		if item == "" {
+			continue
+		}
+
+		i := strings.LastIndex(item, "=")
+		if i == -1 || i == len(item)-1 {
+			return nil, fmt.Errorf("Invalid host mapping %q, expected regex=hosts", item)
+		}
+
+		re, err := regexp.Compile("^(?:" + item[:i] + ")$")
+		if err != nil {
+			return nil, err
+		}
+
+		mappings = append(mappings, hostMapping{re: re, templates: strings.Split(item[i+1:], "|")})
+	}
+
+	return mappings, nil
+}
+
+// Set replaces the mappings of m with those given in the format of
+// parseHostMap.
+func (m *HostMap) Set(s string) error {
+	mappings, err := parseHostMap(s)
+	if err != nil {
+		return err
+	}
+	m.mappings.Store(mappings)
+	return nil
+}
+
+// Hosts returns the Host headers to send for host. The first matching
+// mapping applies.
+func (m *HostMap) Hosts(host string) []string {
+	if m == nil {
+		return []string{host}
+	}
+
+	mappings, _ := m.mappings.Load().([]hostMapping)
+	for _, mapping := range mappings {
+		if !mapping.re.MatchString(host) {
+			continue
+		}
+
+		hosts := make([]string, len(mapping.templates))
+		for i, template := range mapping.templates {
+			hosts[i] = mapping.re.ReplaceAllString(host, template)
+		}
+		return hosts
+	}
+
+	return []string{host}
+}
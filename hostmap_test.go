@@ -0,0 +1,105 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHostMap(t *testing.T) {
+	m := &HostMap{}
+	expectErr(t, m.Set("^upload\\.wikimedia\\.org$"))
+	expectErr(t, m.Set("^upload\\.wikimedia\\.org$="))
+	expectErr(t, m.Set("^(upload\\.wikimedia\\.org$=upload-lb.wikimedia.org"))
+
+	// Empty HostMap
+	assertListEquals(t, m.Hosts("en.wikipedia.org"), []string{"en.wikipedia.org"})
+	assertListEquals(t, (*HostMap)(nil).Hosts("en.wikipedia.org"), []string{"en.wikipedia.org"})
+
+	assertNotErr(t, m.Set("^upload\\.wikimedia\\.org$=upload.wikimedia.org|upload-lb.wikimedia.org,^([a-z]+)\\.wikipedia\\.org$=$1.wikipedia.internal,wikipedia=ignored"))
+
+	assertListEquals(t, m.Hosts("upload.wikimedia.org"), []string{"upload.wikimedia.org", "upload-lb.wikimedia.org"})
+	// First match wins
+	assertListEquals(t, m.Hosts("it.wikipedia.org"), []string{"it.wikipedia.internal"})
+	assertListEquals(t, m.Hosts("www.wikidata.org"), []string{"www.wikidata.org"})
+
+	// Regexes match whole hostnames
+	assertNotErr(t, m.Set("wikipedia\\.org=wikipedia.internal"))
+	assertListEquals(t, m.Hosts("en.wikipedia.org"), []string{"en.wikipedia.org"})
+	assertListEquals(t, m.Hosts("wikipedia.org"), []string{"wikipedia.internal"})
+	assertNotErr(t, m.Set("^upload\\.wikimedia\\.org$=upload.wikimedia.org|upload-lb.wikimedia.org,^([a-z]+)\\.wikipedia\\.org$=$1.wikipedia.internal"))
+
+	// Failing to Set leaves the mappings unchanged
+	expectErr(t, m.Set("("))
+	assertListEquals(t, m.Hosts("it.wikipedia.org"), []string{"it.wikipedia.internal"})
+}
+
+func TestHostMapWorkers(t *testing.T) {
+	var mutex sync.Mutex
+	var beHosts []string
+	var feHosts []string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		beHosts = append(beHosts, req.Host)
+		mutex.Unlock()
+		rw.Write([]byte(`OK`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	frontend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		feHosts = append(feHosts, req.Host)
+		mutex.Unlock()
+		rw.Write([]byte(`OK`))
+	}))
+	defer frontend.Close()
+	frontendURL, _ := url.Parse(frontend.URL)
+
+	assertNotErr(t, hostMaps[backendValue].Set("^upload\\.wikimedia\\.org$=upload.wikimedia.org|upload-lb.wikimedia.org"))
+	defer hostMaps[backendValue].Set("")
+
+	testCh := make(chan Purge, 10)
+	testFrCh := make(chan Purge, 10)
+	testCh <- Purge{URL: "https://upload.wikimedia.org/wikipedia/commons/a/a9/Example.jpg"}
+
+	backends, frontends := startWorkers(backendURL.Host, frontendURL.Host, testCh, testFrCh, nil)
+	defer backends.Resize(0)
+	defer frontends.Resize(0)
+
+	// Wait for the purges to be received by the test servers
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		mutex.Lock()
+		n := len(beHosts) + len(feHosts)
+		mutex.Unlock()
+		if n == 3 {
+			break
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assertListEquals(t, beHosts, []string{"upload.wikimedia.org", "upload-lb.wikimedia.org"})
+	// The frontend HostMap is empty
+	assertListEquals(t, feHosts, []string{"upload.wikimedia.org"})
+}
@@ -0,0 +1,283 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	acceptedValue    = "accepted"
+	rejectedValue    = "rejected"
+	ratelimitedValue = "ratelimited"
+
+	// Maximum size of the body of an HTTP ingestion request, and number of
+	// URLs in it
+	maxIngestBytes = 1 << 20
+	maxIngestURLs  = 1000
+	// Number of clients above which idle rate limiter entries are pruned
+	maxIdleClients = 1024
+)
+
+var (
+	ingestRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged_ingest_requests_total",
+		Help: "Total number of HTTP ingestion requests by status",
+	}, []string{
+		statusLabel,
+	})
+
+	httpLog        = NewLogger(httpValue)
+	rateLimitedLog = httpLog.Limited()
+)
+
+// rateLimiter is a token bucket rate limiter keyed by client address.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// set changes the rate and burst.
+func (l *rateLimiter) set(rate float64, burst int) {
+	l.mutex.Lock()
+	l.rate, l.burst = rate, float64(burst)
+	l.mutex.Unlock()
+}
+
+// allow returns true if client may purge n URLs now. A zero rate disables
+// rate limiting.
+func (l *rateLimiter) allow(client string, n int, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxIdleClients {
+			l.prune(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+	return true
+}
+
+// prune forgets the clients whose bucket would be full by now.
+func (l *rateLimiter) prune(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// HTTPReader accepts purges submitted over HTTP, either as a POST request
+// with a JSON list of URLs or as a PURGE request proxied through.
+type HTTPReader struct {
+	server  *http.Server
+	filter  *HostFilter
+	limiter *rateLimiter
+	c       chan Purge
+
+	// Header carrying the scheme of PURGE requests, set by a trusted proxy,
+	// if any
+	SchemeHeader string
+}
+
+func NewHTTPReader(addr string, filter *HostFilter, rate float64, burst int) *HTTPReader {
+	r := &HTTPReader{filter: filter, limiter: newRateLimiter(rate, burst)}
+	r.server = &http.Server{Addr: addr, Handler: r}
+	return r
+}
+
+// Read serves HTTP ingestion requests, sending the purges to c.
+func (r *HTTPReader) Read(c chan Purge) {
+	r.c = c
+
+	httpLog.Info("Accepting purges over HTTP", "addr", r.server.Addr)
+	if err := r.server.ListenAndServe(); err != http.ErrServerClosed {
+		httpLog.Fatal("Error serving HTTP purge requests", "addr", r.server.Addr, "err", err)
+	}
+}
+
+// SetRate changes the rate limit of each client.
+func (r *HTTPReader) SetRate(rate float64, burst int) {
+	r.limiter.set(rate, burst)
+}
+
+// Stop stops accepting purges, waiting for the requests in progress.
+func (r *HTTPReader) Stop() {
+	r.server.Shutdown(context.Background())
+}
+
+// validate returns an error if rawURL cannot be purged.
+func (r *HTTPReader) validate(rawURL string) error {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return fmt.Errorf("Not an absolute http(s) URL: %s", rawURL)
+	}
+
+	if !r.filter.Match(parsedURL.Host) {
+		return fmt.Errorf("Host not allowed: %s", parsedURL.Host)
+	}
+
+	return nil
+}
+
+type ingestResponse struct {
+	Accepted int
+	Rejected map[string]string `json:",omitempty"`
+}
+
+// scheme returns the scheme of the URL purged by a PURGE request: https if
+// received over TLS, the one given by SchemeHeader if any, http otherwise.
+func (r *HTTPReader) scheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+
+	if r.SchemeHeader != "" {
+		scheme := strings.ToLower(req.Header.Get(r.SchemeHeader))
+		if scheme == "http" || scheme == "https" {
+			return scheme
+		}
+	}
+
+	return "http"
+}
+
+// urls returns the URLs to purge in req.
+func (r *HTTPReader) urls(rw http.ResponseWriter, req *http.Request) ([]string, error) {
+	if req.Method == "PURGE" {
+		return []string{r.scheme(req) + "://" + req.Host + req.URL.RequestURI()}, nil
+	}
+
+	var urls []string
+	dec := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxIngestBytes))
+	if err := dec.Decode(&urls); err != nil {
+		return nil, fmt.Errorf("Expected a JSON list of URLs: %v", err)
+	}
+	return urls, nil
+}
+
+// ServeHTTP validates the URLs of a request and queues them for purging. If
+// any URL is invalid, none is purged.
+func (r *HTTPReader) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "PURGE" && req.Method != http.MethodPost {
+		http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+
+	urls, err := r.urls(rw, req)
+	if err != nil {
+		httpLog.Warn("HTTP purge request rejected", "client", client, "err", err)
+		ingestRequests.With(prometheus.Labels{statusLabel: rejectedValue}).Inc()
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(urls) > maxIngestURLs {
+		httpLog.Warn("HTTP purge request rejected", "client", client, "urls", len(urls))
+		ingestRequests.With(prometheus.Labels{statusLabel: rejectedValue}).Inc()
+		http.Error(rw, fmt.Sprintf("Too many URLs, at most %d per request", maxIngestURLs), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Each URL is charged, so that lists cannot be used to bypass the limit
+	n := len(urls)
+	if n == 0 {
+		n = 1
+	}
+	if !r.limiter.allow(client, n, time.Now()) {
+		rateLimitedLog.Warn("HTTP purge request rate limited", "client", client, "urls", len(urls))
+		ingestRequests.With(prometheus.Labels{statusLabel: ratelimitedValue}).Inc()
+		http.Error(rw, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	resp := ingestResponse{Rejected: make(map[string]string)}
+	for _, u := range urls {
+		if err := r.validate(u); err != nil {
+			resp.Rejected[u] = err.Error()
+		}
+	}
+
+	if len(resp.Rejected) > 0 {
+		httpLog.Warn("HTTP purge request rejected", "client", client, "user_agent", req.UserAgent(), "rejected", len(resp.Rejected), "urls", len(urls))
+		ingestRequests.With(prometheus.Labels{statusLabel: rejectedValue}).Inc()
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusBadRequest)
+		writeJSON(rw, resp)
+		return
+	}
+
+	received := time.Now()
+	for _, u := range urls {
+		r.c <- Purge{URL: u, Source: httpValue, Received: received}
+	}
+	resp.Accepted = len(urls)
+
+	httpLog.Info("HTTP purge request accepted", "client", client, "user_agent", req.UserAgent(), "urls", len(urls))
+	ingestRequests.With(prometheus.Labels{statusLabel: acceptedValue}).Inc()
+	writeJSON(rw, resp)
+}
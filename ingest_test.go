@@ -0,0 +1,154 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupIngestTest(rate float64, burst int) (*HTTPReader, chan Purge) {
+	c := make(chan Purge, 10)
+	hr := NewHTTPReader("", NewHostFilter(regexp.MustCompile(`\.wikipedia\.org$`)), rate, burst)
+	hr.c = c
+	return hr, c
+}
+
+func ingestRequest(hr *HTTPReader, method, target, body string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	hr.ServeHTTP(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rw
+}
+
+func TestIngestPost(t *testing.T) {
+	hr, c := setupIngestTest(0, 0)
+
+	rw := ingestRequest(hr, "POST", "/", `["https://en.wikipedia.org/wiki/Main_Page", "https://it.wikipedia.org/wiki/Pagina_principale"]`)
+	assertEquals(t, rw.Code, http.StatusOK)
+	assertEquals(t, len(c), 2)
+
+	p := <-c
+	assertEquals(t, p.URL, "https://en.wikipedia.org/wiki/Main_Page")
+	assertEquals(t, p.Source, httpValue)
+	<-c
+
+	// One URL not matching the host regex: nothing is purged
+	rw = ingestRequest(hr, "POST", "/", `["https://en.wikipedia.org/wiki/Main_Page", "https://upload.wikimedia.org/a/a9/Example.jpg"]`)
+	assertEquals(t, rw.Code, http.StatusBadRequest)
+	assertEquals(t, strings.Contains(rw.Body.String(), "upload.wikimedia.org"), true)
+	assertEquals(t, len(c), 0)
+
+	// Relative URL
+	rw = ingestRequest(hr, "POST", "/", `["/wiki/Main_Page"]`)
+	assertEquals(t, rw.Code, http.StatusBadRequest)
+
+	// Not a list of URLs
+	rw = ingestRequest(hr, "POST", "/", `{"url": "https://en.wikipedia.org/wiki/Main_Page"}`)
+	assertEquals(t, rw.Code, http.StatusBadRequest)
+
+	rw = ingestRequest(hr, "GET", "/", "")
+	assertEquals(t, rw.Code, http.StatusMethodNotAllowed)
+}
+
+func TestIngestPurge(t *testing.T) {
+	hr, c := setupIngestTest(0, 0)
+
+	rw := ingestRequest(hr, "PURGE", "http://en.wikipedia.org/wiki/Main_Page?action=history", "")
+	assertEquals(t, rw.Code, http.StatusOK)
+	assertEquals(t, (<-c).URL, "http://en.wikipedia.org/wiki/Main_Page?action=history")
+
+	rw = ingestRequest(hr, "PURGE", "http://upload.wikimedia.org/a/a9/Example.jpg", "")
+	assertEquals(t, rw.Code, http.StatusBadRequest)
+	assertEquals(t, len(c), 0)
+}
+
+// The scheme of PURGE requests is kept, so that it is sent to the caches
+func TestIngestPurgeScheme(t *testing.T) {
+	hr, c := setupIngestTest(0, 0)
+
+	// Over TLS
+	rw := ingestRequest(hr, "PURGE", "https://en.wikipedia.org/wiki/Main_Page", "")
+	assertEquals(t, rw.Code, http.StatusOK)
+	assertEquals(t, (<-c).URL, "https://en.wikipedia.org/wiki/Main_Page")
+
+	purge := func() string {
+		req := httptest.NewRequest("PURGE", "http://en.wikipedia.org/wiki/Main_Page", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rw := httptest.NewRecorder()
+		hr.ServeHTTP(rw, req)
+		assertEquals(t, rw.Code, http.StatusOK)
+		return (<-c).URL
+	}
+
+	// The scheme header is only trusted if configured
+	assertEquals(t, purge(), "http://en.wikipedia.org/wiki/Main_Page")
+	hr.SchemeHeader = "X-Forwarded-Proto"
+	assertEquals(t, purge(), "https://en.wikipedia.org/wiki/Main_Page")
+}
+
+func TestIngestRateLimit(t *testing.T) {
+	hr, c := setupIngestTest(1, 2)
+
+	assertEquals(t, ingestRequest(hr, "PURGE", "http://en.wikipedia.org/wiki/Main_Page", "").Code, http.StatusOK)
+	assertEquals(t, ingestRequest(hr, "PURGE", "http://en.wikipedia.org/wiki/Main_Page", "").Code, http.StatusOK)
+	assertEquals(t, ingestRequest(hr, "PURGE", "http://en.wikipedia.org/wiki/Main_Page", "").Code, http.StatusTooManyRequests)
+	assertEquals(t, len(c), 2)
+
+	// Each URL is charged
+	hr, c = setupIngestTest(1, 2)
+	assertEquals(t, ingestRequest(hr, "POST", "/", `["https://en.wikipedia.org/wiki/Main_Page", "https://it.wikipedia.org/wiki/Pagina_principale"]`).Code, http.StatusOK)
+	assertEquals(t, ingestRequest(hr, "PURGE", "http://en.wikipedia.org/wiki/Main_Page", "").Code, http.StatusTooManyRequests)
+	assertEquals(t, len(c), 2)
+}
+
+func TestIngestMaxURLs(t *testing.T) {
+	hr, c := setupIngestTest(0, 0)
+
+	urls := make([]string, maxIngestURLs+1)
+	for i := range urls {
+		urls[i] = `"https://en.wikipedia.org/wiki/Main_Page"`
+	}
+	rw := ingestRequest(hr, "POST", "/", "["+strings.Join(urls, ",")+"]")
+	assertEquals(t, rw.Code, http.StatusRequestEntityTooLarge)
+	assertEquals(t, len(c), 0)
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 1)
+	now := time.Now()
+
+	assertEquals(t, l.allow("10.0.0.1", 1, now), true)
+	assertEquals(t, l.allow("10.0.0.1", 1, now), false)
+	// Other clients have their own bucket
+	assertEquals(t, l.allow("10.0.0.2", 1, now), true)
+
+	// Tokens are refilled at the given rate
+	assertEquals(t, l.allow("10.0.0.1", 1, now.Add(500*time.Millisecond)), true)
+	assertEquals(t, l.allow("10.0.0.1", 1, now.Add(500*time.Millisecond)), false)
+
+	// Requests for more URLs than the burst are never allowed
+	assertEquals(t, l.allow("10.0.0.3", 2, now), false)
+	assertEquals(t, l.allow("10.0.0.3", 1, now), true)
+
+	// Idle clients are forgotten
+	l.prune(now.Add(time.Second))
+	assertEquals(t, len(l.buckets), 0)
+}
@@ -19,7 +19,8 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
-	"log"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,8 +39,12 @@ type KafkaConsumerAPI interface {
 	Close() error
 	SubscribeTopics([]string, kafka.RebalanceCb) error
 	Events() chan kafka.Event
+	StoreOffsets([]kafka.TopicPartition) ([]kafka.TopicPartition, error)
 }
 
+// How often to store the offsets of processed messages, with Offsets
+const offsetStoreInterval = time.Second
+
 // KafkaReader allows to read purge events from Kafka.
 type KafkaReader struct {
 	// The kafka consumer
@@ -55,13 +60,33 @@ type KafkaReader struct {
 	maxts      map[string]time.Time
 	maxtsMutex sync.RWMutex
 
-	// The channel for communicating execution is complete
+	// Sending on Done stops the reader, leaving the consumer open until
+	// Close is called
 	Done chan struct{}
 
+	// Which bans are allowed. If nil, events asking for a ban are rejected.
+	BanGuard *BanGuard
+
 	// rdkafka prometheus metrics
 	metrics *promrdkafka.Metrics
+
+	// If not nil, offsets are stored once the purges read up to them are
+	// processed, rather than automatically once read
+	Offsets *OffsetTracker
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
+var (
+	kafkaLog = NewLogger(kafkaValue)
+	// Hot path errors, on bad input
+	decodeErrorLog = kafkaLog.Limited()
+	storeErrorLog  = kafkaLog.Limited()
+	banRejectedLog = kafkaLog.Limited()
+	kafkaErrorLog  = kafkaLog.Limited()
+)
+
 // Kafka Prometheus metrics
 var purgeEvents = promauto.NewCounterVec(
 	prometheus.CounterOpts{
@@ -84,12 +109,12 @@ func loadConfig(f string) *kafka.ConfigMap {
 	var vals kafka.ConfigMap
 	jsonConfig, err := ioutil.ReadFile(f)
 	if err != nil {
-		log.Fatal(err)
+		kafkaLog.Fatal("Error reading the kafka configuration", "file", f, "err", err)
 	}
 
 	err = json.Unmarshal(jsonConfig, &vals)
 	if err != nil {
-		log.Fatal(err)
+		kafkaLog.Fatal("Error parsing the kafka configuration", "file", f, "err", err)
 	}
 
 	// Convert float64 values to int. When unmarshaling into an interface
@@ -104,12 +129,16 @@ func loadConfig(f string) *kafka.ConfigMap {
 	return &vals
 }
 
-// NewKafkaReader creates a new kafka consumer based on the configuration provided.
-func NewKafkaReader(configFile string, topics []string, d chan struct{}, maxage int) (*KafkaReader, error) {
+// NewKafkaReader creates a new kafka consumer based on the configuration
+// provided. Offsets, if not nil, tracks the messages being processed.
+func NewKafkaReader(configFile string, topics []string, d chan struct{}, maxage int, offsets *OffsetTracker) (*KafkaReader, error) {
 	config := loadConfig(configFile)
+	if offsets != nil {
+		(*config)["enable.auto.offset.store"] = false
+	}
 	consumer, err := kafka.NewConsumer(config)
 	if err != nil {
-		log.Println("Unable to create a kafka consumer from the configuration")
+		kafkaLog.Error("Unable to create a kafka consumer from the configuration", "file", configFile)
 		return nil, err
 	}
 	m := time.Duration(maxage) * time.Second
@@ -121,6 +150,7 @@ func NewKafkaReader(configFile string, topics []string, d chan struct{}, maxage
 		maxts:      make(map[string]time.Time, len(topics)),
 		maxtsMutex: sync.RWMutex{},
 		metrics:    promrdkafka.NewMetrics(),
+		Offsets:    offsets,
 	}
 
 	return &kr, nil
@@ -150,7 +180,7 @@ func (k *KafkaReader) GetLag(topic string) float64 {
 	return float64(time.Now().Sub(maxts).Nanoseconds())
 }
 
-func (k *KafkaReader) manageEvent(event kafka.Event, c chan string) bool {
+func (k *KafkaReader) manageEvent(event kafka.Event, c chan Purge) bool {
 	consume := true
 	switch e := event.(type) {
 	case *kafka.Message:
@@ -165,7 +195,7 @@ func (k *KafkaReader) manageEvent(event kafka.Event, c chan string) bool {
 		status := "discarded"
 		if err != nil {
 			// TODO - add a prometheus counter?
-			log.Printf("Could not decode the message: %v\n", err)
+			decodeErrorLog.Warn("Could not decode the message", "topic", topic, "partition", e.TopicPartition.Partition, "offset", e.TopicPartition.Offset, "err", err)
 		} else {
 			if len(rc.Tags) > 0 {
 				tag = rc.Tags[0]
@@ -180,46 +210,107 @@ func (k *KafkaReader) manageEvent(event kafka.Event, c chan string) bool {
 					status = "expired"
 				}
 			}
+			p := Purge{URL: *rc.GetURL(), Source: kafkaValue, Topic: topic, Tags: rc.Tags, EventTime: rc.GetTS(), Received: time.Now(), EventID: rc.Event.ID, RequestID: rc.Event.RequestID, Partition: e.TopicPartition.Partition, Offset: int64(e.TopicPartition.Offset)}
+			if len(rc.Keys) > 0 {
+				p.Kind, p.Keys = xkeyKind, rc.Keys
+			} else if sendMsg && rc.Ban != "" {
+				p.Kind, p.Pattern = banKind, rc.Ban
+				if err := k.checkBan(p); err != nil {
+					banRejectedLog.Warn("Rejecting ban", "topic", topic, "partition", e.TopicPartition.Partition, "url", p.URL, "pattern", p.Pattern, "err", err)
+					sendMsg = false
+					status = "rejected"
+				}
+			}
 			if sendMsg {
 				status = "ok"
-				c <- *rc.GetURL()
+				c <- p
 			}
 		}
 		purgeEvents.With(prometheus.Labels{"tag": tag, "status": status, "topic": topic}).Inc()
 	case *kafka.Stats:
 		err := k.metrics.Update(e.String())
 		if err != nil {
-			log.Printf("Unable to update promrdkafka metrics: %v\n", err)
+			kafkaLog.Warn("Unable to update promrdkafka metrics", "err", err)
 		}
 	case *kafka.Error:
 		// TODO: when moving to a newer version of librdkafka, use e.IsFatal()
-		log.Printf("Error (code %d) reading from kafka: %v", e.Code(), e.Error())
+		kafkaErrorLog.Error("Error reading from kafka", "code", int(e.Code()), "err", e.Error())
 		consume = false
 	}
 	return consume
 }
 
-// Read reads messages from the kafka topics we're subscribing to, and returns the URL on the channel
-func (k *KafkaReader) Read(c chan string) {
+// checkBan returns an error if the ban requested by p is not allowed.
+func (k *KafkaReader) checkBan(p Purge) error {
+	parsedURL, err := url.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	return k.BanGuard.Check(parsedURL.Host, p.Pattern)
+}
+
+// storeOffsets stores the offsets of the processed messages, to be committed
+// by the consumer.
+func (k *KafkaReader) storeOffsets() {
+	var offsets []kafka.TopicPartition
+	for tp, offset := range k.Offsets.Processed() {
+		topic := tp.Topic
+		offsets = append(offsets, kafka.TopicPartition{Topic: &topic, Partition: tp.Partition, Offset: kafka.Offset(offset)})
+	}
+
+	if len(offsets) == 0 {
+		return
+	}
+
+	if _, err := k.Reader.StoreOffsets(offsets); err != nil {
+		storeErrorLog.Error("Error storing offsets", "err", err)
+	}
+}
+
+// Read reads messages from the kafka topics we're subscribing to, and returns the purges on the channel
+func (k *KafkaReader) Read(c chan Purge) {
 	err := k.Reader.SubscribeTopics(k.Topics, nil)
 	if err != nil {
-		log.Fatalf("Could not subscribe the topics %v: %v\n", k.Topics, err)
+		kafkaLog.Fatal("Could not subscribe the topics", "topics", strings.Join(k.Topics, ","), "err", err)
 	}
 	consume := true
-	log.Printf("Start consuming topics %v from kafka", k.Topics)
+	kafkaLog.Info("Start consuming topics from kafka", "topics", strings.Join(k.Topics, ","))
+
+	var store <-chan time.Time
+	if k.Offsets != nil {
+		ticker := time.NewTicker(offsetStoreInterval)
+		defer ticker.Stop()
+		store = ticker.C
+	}
+
 	// Eventloop that gets messages from Events()
 	for consume == true {
 		select {
 		case <-k.Done:
-			consume = false
+			// The purges read are still being processed, their offsets are
+			// committed by Close
+			return
 		case event := <-k.Reader.Events():
 			consume = k.manageEvent(event, c)
+		case <-store:
+			k.storeOffsets()
 		}
 	}
-	err = k.Reader.Close()
-	// now close the channel so the main process can terminate
-	defer close(k.Done)
+
+	err = k.Close()
 	if err != nil {
-		log.Fatalf("Error trying to close the subscription to kafka: %v\n", err)
+		kafkaLog.Fatal("Error trying to close the subscription to kafka", "err", err)
 	}
 }
+
+// Close stores the offsets of the processed messages, if tracked, and closes
+// the consumer, committing them. Read must have returned.
+func (k *KafkaReader) Close() error {
+	k.closeOnce.Do(func() {
+		if k.Offsets != nil {
+			k.storeOffsets()
+		}
+		k.closeErr = k.Reader.Close()
+	})
+	return k.closeErr
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"regexp"
 	"testing"
 	"time"
 
@@ -29,6 +30,7 @@ type MockConsumer struct {
 	IsClosed  bool
 	EventChan chan kafka.Event
 	Topics    []string
+	Stored    []kafka.TopicPartition
 }
 
 func NewMockConsumer(ev chan kafka.Event) *MockConsumer {
@@ -52,6 +54,11 @@ func (m *MockConsumer) Events() chan kafka.Event {
 	return m.EventChan
 }
 
+func (m *MockConsumer) StoreOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	m.Stored = append(m.Stored, offsets...)
+	return offsets, nil
+}
+
 // Setup the Kafka reader, send events on the mockconsumer.
 func setupKafkaReaderTest(events [][]byte, inject bool) (*KafkaReader, *MockConsumer) {
 	chansize := len(events) + 1
@@ -105,7 +112,7 @@ func TestReadGoodMessage(t *testing.T) {
 	}
 
 	kr, mr := setupKafkaReaderTest(events, true)
-	c := make(chan string, 1)
+	c := make(chan Purge, 1)
 	d := make(chan struct{})
 	kr.Done = d
 	kr.Read(c)
@@ -115,9 +122,12 @@ func TestReadGoodMessage(t *testing.T) {
 	if mr.IsClosed == false {
 		t.Errorf("The consumer was not closed")
 	}
-	url := <-c
-	if url != "https://it.wikipedia.org/wiki/Francesco_Totti" {
-		t.Errorf("Unexpected url transmitted: %v", url)
+	p := <-c
+	if p.URL != "https://it.wikipedia.org/wiki/Francesco_Totti" {
+		t.Errorf("Unexpected url transmitted: %v", p.URL)
+	}
+	if p.Source != kafkaValue || p.Topic != "topic1" || len(p.Tags) != 1 || p.Tags[0] != "test" {
+		t.Errorf("Unexpected purge transmitted: %v", p)
 	}
 	// Check that the lag has been set to non-zero values.
 	if kr.GetLag("topic1") == 0 {
@@ -139,7 +149,7 @@ func TestDiscardMessage(t *testing.T) {
 		}`),
 	}
 	kr, _ := setupKafkaReaderTest(events, true)
-	c := make(chan string, 1)
+	c := make(chan Purge, 1)
 	d := make(chan struct{})
 	kr.Done = d
 	// This surely is later than april 2020 :)
@@ -169,7 +179,7 @@ func TestBadJsonMessage(t *testing.T) {
 		}`),
 	}
 	kr, mr := setupKafkaReaderTest(events, true)
-	c := make(chan string, 1)
+	c := make(chan Purge, 1)
 	d := make(chan struct{})
 	kr.Done = d
 	kr.Read(c)
@@ -194,7 +204,7 @@ func TestBadMessage(t *testing.T) {
 	}
 	// Do not inject errors, to check the test ends by just
 	kr, _ := setupKafkaReaderTest(events, false)
-	c := make(chan string, 1)
+	c := make(chan Purge, 1)
 	d := make(chan struct{})
 	kr.Done = d
 	// Send the "done" message after 1 second
@@ -233,8 +243,70 @@ func BenchmarkManageFullEvent(b *testing.B) {
 	e := kafka.Message{Value: evdata}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		c := make(chan string, 1)
+		c := make(chan Purge, 1)
 		kr.manageEvent(&e, c)
 		close(c)
 	}
 }
+
+// Ban events are only accepted if allowed by the BanGuard
+func TestBanMessage(t *testing.T) {
+	events := [][]byte{
+		[]byte(`{
+			"$schema": "/resource_change/1.0.0",
+			"meta": {
+				"dt": "2020-04-30T11:37:53Z",
+				"stream": "purge",
+				"uri": "https://upload.wikimedia.org/wikipedia/commons/thumb/7/78/Flag_of_Italy.svg"
+			},
+			"ban": "^/wikipedia/commons/thumb/7/78/"
+		}`),
+	}
+
+	kr, _ := setupKafkaReaderTest(events, true)
+	c := make(chan Purge, 1)
+	kr.Done = make(chan struct{})
+	kr.Read(c)
+	if len(c) != 0 {
+		t.Errorf("A ban was accepted without a BanGuard")
+	}
+
+	kr, _ = setupKafkaReaderTest(events, true)
+	kr.Done = make(chan struct{})
+	kr.BanGuard = &BanGuard{Hosts: regexp.MustCompile(`^upload\.`), MinPrefix: 10}
+	kr.Read(c)
+	if len(c) != 1 {
+		t.Fatalf("Found %d messages, 1 expected", len(c))
+	}
+	p := <-c
+	if p.Kind != banKind || p.Pattern != "^/wikipedia/commons/thumb/7/78/" {
+		t.Errorf("Unexpected purge transmitted: %v", p)
+	}
+}
+
+// The metadata of the event and message are preserved in the purge
+func TestReadMetadata(t *testing.T) {
+	kr, _ := setupKafkaReaderTest(nil, false)
+	c := make(chan Purge, 1)
+
+	topic := "topic1"
+	kr.manageEvent(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 4242},
+		Value: []byte(`{
+			"meta": {
+				"dt": "2020-04-30T11:37:53Z",
+				"id": "aa2e4b8e-2d5d-4bd8-8ad2-b2b8f5e0c0e1",
+				"request_id": "b2ec1c5c-9d5b-4c4b-a4a4-1d2ec2b8d5b4",
+				"uri": "https://it.wikipedia.org/wiki/Francesco_Totti"
+			}
+		}`),
+	}, c)
+
+	p := <-c
+	assertEquals(t, p.Topic, "topic1")
+	assertEquals(t, p.Partition, int32(3))
+	assertEquals(t, p.Offset, int64(4242))
+	assertEquals(t, p.EventID, "aa2e4b8e-2d5d-4bd8-8ad2-b2b8f5e0c0e1")
+	assertEquals(t, p.RequestID, "b2ec1c5c-9d5b-4c4b-a4a4-1d2ec2b8d5b4")
+	assertEquals(t, p.EventTime.Equal(time.Date(2020, 4, 30, 11, 37, 53, 0, time.UTC)), true)
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const topicLabel = "topic"
+
+var (
+	purgeLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "purged_purge_latency_seconds",
+		Help:    "Time from the event timestamp of a purge, or from when it was received if it has none, to its acknowledgement by each layer",
+		Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{
+		layerLabel,
+		sourceLabel,
+		topicLabel,
+	})
+	queuedSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "purged_queued_seconds",
+		Help:    "Time spent by purges queued for the backend and frontend workers",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 12),
+	}, []string{
+		layerLabel,
+		priorityLabel,
+	})
+)
+
+// origin returns the time the latency of p is measured from.
+func origin(p Purge) time.Time {
+	if !p.EventTime.IsZero() {
+		return p.EventTime
+	}
+	return p.Received
+}
+
+// observeAck records the latency of p, acknowledged by layer at now.
+func observeAck(layer string, p Purge, now time.Time) {
+	t := origin(p)
+	if t.IsZero() {
+		return
+	}
+
+	purgeLatency.With(prometheus.Labels{
+		layerLabel:  layer,
+		sourceLabel: p.Source,
+		topicLabel:  p.Topic,
+	}).Observe(now.Sub(t).Seconds())
+}
+
+// observeQueued records the time spent by p in the queue of layer, until now.
+func observeQueued(layer, priority string, p Purge, now time.Time) {
+	if p.queued.IsZero() {
+		return
+	}
+
+	queuedSeconds.With(prometheus.Labels{
+		layerLabel:    layer,
+		priorityLabel: priority,
+	}).Observe(now.Sub(p.queued).Seconds())
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func histogram(t *testing.T, vec *prometheus.HistogramVec, labels prometheus.Labels) *dto.Histogram {
+	var m dto.Metric
+	assertNotErr(t, vec.With(labels).(prometheus.Histogram).Write(&m))
+	return m.GetHistogram()
+}
+
+func TestObserveAck(t *testing.T) {
+	now := time.Now()
+	labels := prometheus.Labels{layerLabel: backendValue, sourceLabel: "test-ack", topicLabel: "eqiad.resource-purge"}
+
+	// The histogram is global, only what is observed by the test counts
+	before := histogram(t, purgeLatency, labels)
+
+	// From the event timestamp
+	observeAck(backendValue, Purge{Source: "test-ack", Topic: "eqiad.resource-purge", EventTime: now.Add(-3 * time.Second), Received: now.Add(-time.Second)}, now)
+	h := histogram(t, purgeLatency, labels)
+	assertEquals(t, h.GetSampleCount()-before.GetSampleCount(), uint64(1))
+	assertEquals(t, h.GetSampleSum()-before.GetSampleSum(), float64(3))
+
+	// From the receive time
+	observeAck(backendValue, Purge{Source: "test-ack", Topic: "eqiad.resource-purge", Received: now.Add(-time.Second)}, now)
+	h = histogram(t, purgeLatency, labels)
+	assertEquals(t, h.GetSampleCount()-before.GetSampleCount(), uint64(2))
+	assertEquals(t, h.GetSampleSum()-before.GetSampleSum(), float64(4))
+
+	// Neither
+	observeAck(backendValue, Purge{Source: "test-ack", Topic: "eqiad.resource-purge"}, now)
+	assertEquals(t, histogram(t, purgeLatency, labels).GetSampleCount()-before.GetSampleCount(), uint64(2))
+}
+
+func TestObserveQueued(t *testing.T) {
+	queue, err := NewPriorityQueue("test-urgent:10,test-bulk:1", "tag=bulk:test-bulk", "test-urgent", 10)
+	assertNotErr(t, err)
+
+	urgent := prometheus.Labels{layerLabel: backendValue, priorityLabel: "test-urgent"}
+	bulk := prometheus.Labels{layerLabel: backendValue, priorityLabel: "test-bulk"}
+	queued := func(labels prometheus.Labels) uint64 {
+		return histogram(t, queuedSeconds, labels).GetSampleCount()
+	}
+	urgentBefore, bulkBefore := queued(urgent), queued(bulk)
+
+	queue.Push(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"})
+	queue.TryPush(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Tags: []string{"bulk"}})
+
+	chout := make(chan Purge)
+	go queue.Run(chout)
+
+	for i := 0; i < 2; i++ {
+		p := <-chout
+		assertEquals(t, p.queued.IsZero(), false)
+	}
+
+	// Observed once taken by a worker
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if queued(bulk)-bulkBefore == 1 {
+			break
+		}
+	}
+
+	assertEquals(t, queued(urgent)-urgentBefore, uint64(1))
+	assertEquals(t, queued(bulk)-bulkBefore, uint64(1))
+}
@@ -0,0 +1,329 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	debugLevel logLevel = iota
+	infoLevel
+	warnLevel
+	errorLevel
+
+	jsonFormat   = "json"
+	logfmtFormat = "logfmt"
+
+	componentLabel = "component"
+)
+
+var (
+	levelNames = []string{"debug", "info", "warn", "error"}
+
+	// Per component log levels, set with setLogLevels
+	componentLevels atomic.Value
+
+	// Where log messages are written to
+	logMutex  sync.Mutex
+	logOutput io.Writer = os.Stderr
+
+	logSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged_log_suppressed_total",
+		Help: "Total number of log messages suppressed by rate limiting",
+	}, []string{
+		componentLabel,
+	})
+)
+
+type logLevel int
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level %q", s)
+}
+
+// levelConfig holds the log level of each component, and the level of those
+// not listed.
+type levelConfig struct {
+	def        logLevel
+	components map[string]logLevel
+}
+
+// parseLogLevels parses a comma separated list of levels, each optionally
+// prefixed by the component it applies to, eg: info,kafka:debug,multicast:error
+func parseLogLevels(s string) (*levelConfig, error) {
+	c := &levelConfig{def: infoLevel, components: make(map[string]logLevel)}
+
+	for _, item := range strings.Split(s, ",") {
+		if item == "" {
+			continue
+		}
+
+		component := ""
+		if i := strings.Index(item, ":"); i != -1 {
+			component, item = item[:i], item[i+1:]
+		}
+
+		level, err := parseLogLevel(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if component == "" {
+			c.def = level
+		} else {
+			c.components[component] = level
+		}
+	}
+
+	return c, nil
+}
+
+// setLogLevels sets the log levels in the format of parseLogLevels.
+func setLogLevels(s string) error {
+	c, err := parseLogLevels(s)
+	if err != nil {
+		return err
+	}
+	componentLevels.Store(c)
+	return nil
+}
+
+func enabled(component string, level logLevel) bool {
+	c, _ := componentLevels.Load().(*levelConfig)
+	if c == nil {
+		return level >= infoLevel
+	}
+
+	min, ok := c.components[component]
+	if !ok {
+		min = c.def
+	}
+	return level >= min
+}
+
+// logLimiter allows a burst of messages, refilled at -log_rate messages per
+// second, counting the messages suppressed in between.
+type logLimiter struct {
+	mutex      sync.Mutex
+	tokens     float64
+	last       time.Time
+	suppressed int
+}
+
+// allow returns true if a message can be logged at time now, along with the
+// number of messages suppressed since the last one.
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	rate := logRate.Load()
+	if rate <= 0 {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+
+	if l.last.IsZero() {
+		l.tokens = burst
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+		if l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		l.suppressed++
+		return false, 0
+	}
+
+	l.tokens--
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
+
+// Logger writes leveled, structured log messages for a component of purged.
+// Messages are followed by key-value pairs, eg:
+// log.Warn("Error purging", "layer", layer, "err", err)
+type Logger struct {
+	component string
+	limiter   *logLimiter
+}
+
+func NewLogger(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// Limited returns a Logger writing at most -log_rate messages per second, for
+// errors on hot paths. Each rate limited call site needs its own Logger.
+func (l *Logger) Limited() *Logger {
+	return &Logger{component: l.component, limiter: &logLimiter{}}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(debugLevel, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(infoLevel, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(warnLevel, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(errorLevel, msg, kv)
+}
+
+// Fatal logs an error and exits.
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(errorLevel, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level logLevel, msg string, kv []interface{}) {
+	if !enabled(l.component, level) {
+		return
+	}
+
+	now := time.Now()
+	if l.limiter != nil {
+		ok, suppressed := l.limiter.allow(now)
+		if !ok {
+			logSuppressed.With(prometheus.Labels{componentLabel: l.component}).Inc()
+			return
+		}
+		if suppressed > 0 {
+			kv = append(kv[:len(kv):len(kv)], "suppressed", suppressed)
+		}
+	}
+
+	fields := []interface{}{
+		"time", now.UTC().Format(time.RFC3339Nano),
+		"level", level.String(),
+		componentLabel, l.component,
+		"msg", msg,
+	}
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	var line []byte
+	if *logFormat == jsonFormat {
+		line = encodeJSON(fields)
+	} else {
+		line = encodeLogfmt(fields)
+	}
+
+	logMutex.Lock()
+	logOutput.Write(line)
+	logMutex.Unlock()
+}
+
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// encodeJSON returns fields as a JSON object, keeping their order.
+func encodeJSON(fields []interface{}) []byte {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		b.Write(key)
+		b.WriteByte(':')
+
+		value, err := json.Marshal(logValue(fields[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(fields[i+1]))
+		}
+		b.Write(value)
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+// encodeLogfmt returns fields as key=value pairs, quoting values if needed.
+func encodeLogfmt(fields []interface{}) []byte {
+	var b bytes.Buffer
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+
+		b.WriteString(fmt.Sprint(fields[i]))
+		b.WriteByte('=')
+
+		value := fmt.Sprint(logValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\\") || strings.IndexFunc(value, func(r rune) bool { return r < ' ' }) != -1 {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// stdLogWriter sends the messages of the standard log package, used by the
+// libraries, to a Logger.
+type stdLogWriter struct {
+	log *Logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.log.Info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs returns the buffer log messages are written to until the
+// returned function is called.
+func captureLogs(t *testing.T, levels string) (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+
+	logMutex.Lock()
+	logOutput = &buf
+	logMutex.Unlock()
+	assertNotErr(t, setLogLevels(levels))
+
+	return &buf, func() {
+		logMutex.Lock()
+		logOutput = os.Stderr
+		logMutex.Unlock()
+		setLogLevels("")
+	}
+}
+
+func TestParseLogLevels(t *testing.T) {
+	_, err := parseLogLevels("verbose")
+	expectErr(t, err)
+	_, err = parseLogLevels("info,kafka:verbose")
+	expectErr(t, err)
+
+	c, err := parseLogLevels("")
+	assertNotErr(t, err)
+	assertEquals(t, c.def, infoLevel)
+
+	c, err = parseLogLevels("warn,kafka:debug,multicast:error")
+	assertNotErr(t, err)
+	assertEquals(t, c.def, warnLevel)
+	assertEquals(t, c.components[kafkaValue], debugLevel)
+	assertEquals(t, c.components[multicastValue], errorLevel)
+}
+
+func TestLogLevels(t *testing.T) {
+	buf, restore := captureLogs(t, "warn,kafka:debug")
+	defer restore()
+
+	NewLogger(kafkaValue).Debug("kafka debug")
+	NewLogger(multicastValue).Info("multicast info")
+	NewLogger(multicastValue).Warn("multicast warn")
+
+	out := buf.String()
+	assertEquals(t, strings.Contains(out, "kafka debug"), true)
+	assertEquals(t, strings.Contains(out, "multicast info"), false)
+	assertEquals(t, strings.Contains(out, "multicast warn"), true)
+}
+
+func TestLogfmt(t *testing.T) {
+	line := string(encodeLogfmt([]interface{}{
+		"msg", "Error purging",
+		"layer", backendValue,
+		"err", errors.New(`bad "thing"`),
+		"empty", "",
+		"n", 42,
+	}))
+	assertEquals(t, line, `msg="Error purging" layer=backend err="bad \"thing\"" empty="" n=42`+"\n")
+}
+
+func TestLogJSON(t *testing.T) {
+	*logFormat = jsonFormat
+	defer func() { *logFormat = logfmtFormat }()
+
+	buf, restore := captureLogs(t, "")
+	defer restore()
+
+	NewLogger(kafkaValue).Warn("Could not decode the message", "topic", "eqiad.resource-purge", "partition", 3, "err", errors.New("unexpected EOF"))
+
+	var entry map[string]interface{}
+	assertNotErr(t, json.Unmarshal(buf.Bytes(), &entry))
+	assertEquals(t, entry["level"], "warn")
+	assertEquals(t, entry["component"], kafkaValue)
+	assertEquals(t, entry["msg"], "Could not decode the message")
+	assertEquals(t, entry["topic"], "eqiad.resource-purge")
+	assertEquals(t, entry["partition"], float64(3))
+	assertEquals(t, entry["err"], "unexpected EOF")
+
+	// Fields are in order
+	assertEquals(t, strings.HasPrefix(buf.String(), `{"time":`), true)
+}
+
+func TestLogLimiter(t *testing.T) {
+	defer logRate.Set(logRate.String())
+	logRate.Set("2")
+
+	l := &logLimiter{}
+	now := time.Now()
+
+	// Burst
+	ok, _ := l.allow(now)
+	assertEquals(t, ok, true)
+	ok, _ = l.allow(now)
+	assertEquals(t, ok, true)
+	ok, _ = l.allow(now)
+	assertEquals(t, ok, false)
+	ok, _ = l.allow(now)
+	assertEquals(t, ok, false)
+
+	// Refilled at 2 messages per second, reporting the suppressed ones
+	ok, suppressed := l.allow(now.Add(500 * time.Millisecond))
+	assertEquals(t, ok, true)
+	assertEquals(t, suppressed, 2)
+
+	// No limit
+	logRate.Set("0")
+	for i := 0; i < 10; i++ {
+		ok, _ = l.allow(now)
+		assertEquals(t, ok, true)
+	}
+}
+
+func TestLogLimited(t *testing.T) {
+	defer logRate.Set(logRate.String())
+	logRate.Set("1")
+
+	buf, restore := captureLogs(t, "")
+	defer restore()
+
+	limited := NewLogger(multicastValue).Limited()
+	for i := 0; i < 100; i++ {
+		limited.Error("Invalid HTCP packet")
+	}
+	assertEquals(t, strings.Count(buf.String(), "Invalid HTCP packet"), 1)
+}
@@ -20,9 +20,9 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -30,7 +30,7 @@ import (
 )
 
 type PurgeReader interface {
-	Read(c chan string)
+	Read(c chan Purge)
 }
 
 type MultiCastReader struct {
@@ -38,6 +38,8 @@ type MultiCastReader struct {
 	// how big we try to set the kernel buffer via setsockopt()
 	kbufSize   int
 	mcastAddrs string
+	// Closing Done stops the reader
+	Done chan struct{}
 }
 
 const (
@@ -58,6 +60,11 @@ var (
 		Name: "purged_udp_bytes_read_total",
 		Help: "Total number of UDP bytes read",
 	})
+
+	multicastLog = NewLogger(multicastValue)
+	// Hot path errors, on bad input
+	readErrorLog   = multicastLog.Limited()
+	packetErrorLog = multicastLog.Limited()
 )
 
 func extractURL(buffer []byte, n int) (string, error) {
@@ -107,14 +114,14 @@ func extractURL(buffer []byte, n int) (string, error) {
 // Continuously read from the given multicast addresses, extract URLs to be
 // purged and quickly offload the data to the provided buffered channel
 // "churls".
-func (pr MultiCastReader) readFromAddrs(churls chan string, mcastAddrs string) {
+func (pr MultiCastReader) readFromAddrs(churls chan Purge, mcastAddrs string) {
 	conn, err := net.ListenPacket("udp4", "0.0.0.0:4827")
 	if err != nil {
-		log.Fatal(err)
+		multicastLog.Fatal("Error listening for multicast packets", "err", err)
 	}
 
 	if err := conn.(*net.UDPConn).SetReadBuffer(pr.kbufSize); err != nil {
-		log.Fatal(err)
+		multicastLog.Fatal("Error setting the kernel buffer size", "size", pr.kbufSize, "err", err)
 	}
 
 	p := ipv4.NewPacketConn(conn)
@@ -123,31 +130,45 @@ func (pr MultiCastReader) readFromAddrs(churls chan string, mcastAddrs string) {
 		g := net.ParseIP(addr)
 
 		if err := p.JoinGroup(nil, &net.UDPAddr{IP: g}); err != nil {
-			log.Fatal(err)
+			multicastLog.Fatal("Error joining multicast group", "addr", addr, "err", err)
 		}
 	}
 
+	go func() {
+		<-pr.Done
+		p.Close()
+	}()
+
 	buffer := make([]byte, pr.maxDatagramSize)
 
-	log.Printf("Reading from %s with maximum datagram size %d", mcastAddrs, pr.maxDatagramSize)
+	multicastLog.Info("Reading multicast packets", "addrs", mcastAddrs, "max_datagram_size", pr.maxDatagramSize)
 
 	for {
 		readBytes, _, src, err := p.ReadFrom(buffer)
+		select {
+		case <-pr.Done:
+			multicastLog.Info("Stopped reading multicast packets", "addrs", mcastAddrs)
+			return
+		default:
+		}
+
 		if err != nil {
-			log.Println("Error while reading from", src, "->", err)
+			readErrorLog.Error("Error reading multicast packet", "src", src, "err", err)
 			continue
 		}
 
 		url, err := extractURL(buffer, readBytes)
 		if err != nil {
-			log.Println(err)
+			packetErrorLog.Warn("Invalid HTCP packet", "src", src, "err", err)
 			continue
 		}
 
-		churls <- url
+		// Received now, so that -multicast_max_age includes the time spent
+		// waiting for the ingress
+		churls <- Purge{URL: url, Source: multicastValue, Received: time.Now()}
 	}
 }
 
-func (pr MultiCastReader) Read(churls chan string) {
+func (pr MultiCastReader) Read(churls chan Purge) {
 	pr.readFromAddrs(churls, pr.mcastAddrs)
 }
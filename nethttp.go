@@ -0,0 +1,147 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// HTTPPurgerOptions tunes the connections of HTTPPurgers to the caches.
+type HTTPPurgerOptions struct {
+	// Maximum number of idle connections kept open to the cache, and for how
+	// long. Over h2c, the only connection is kept open for IdleTimeout.
+	MaxIdleConns int
+	IdleTimeout  time.Duration
+	// Timeout of each request, zero for none
+	Timeout time.Duration
+	// Configuration to connect to the cache over HTTPS, nil for plain HTTP
+	TLS *tls.Config
+	// Whether to speak HTTP/2: negotiated via ALPN over TLS, with prior
+	// knowledge (h2c) otherwise. The requests of all HTTPPurgers to the same
+	// cache are multiplexed on one connection, which closing an HTTPPurger
+	// leaves open.
+	HTTP2 bool
+}
+
+var (
+	// Options of the HTTPPurgers started by the workers
+	httpPurgerOptions = HTTPPurgerOptions{MaxIdleConns: 1}
+
+	// HTTP/2 transports shared by all HTTPPurgers, by cache address
+	http2Transports      = make(map[string]http.RoundTripper)
+	http2TransportsMutex sync.Mutex
+)
+
+// baseURL returns the scheme and host of the requests sent to addr. The
+// requests to unix sockets are sent to localhost.
+func (o HTTPPurgerOptions) baseURL(addr string) string {
+	scheme := "http"
+	if o.TLS != nil {
+		scheme = "https"
+	}
+
+	if network, _ := splitAddr(addr); network == "unix" {
+		return scheme + "://localhost"
+	}
+	return scheme + "://" + addr
+}
+
+// transport returns the RoundTripper used to send requests to addr.
+func (o HTTPPurgerOptions) transport(addr string) http.RoundTripper {
+	if !o.HTTP2 {
+		return o.newTransport(addr)
+	}
+
+	http2TransportsMutex.Lock()
+	defer http2TransportsMutex.Unlock()
+
+	t, ok := http2Transports[addr]
+	if !ok {
+		t = o.newTransport(addr)
+		http2Transports[addr] = t
+	}
+	return t
+}
+
+// newTransport returns a RoundTripper connecting to addr, whatever the host
+// of the request URLs.
+func (o HTTPPurgerOptions) newTransport(addr string) http.RoundTripper {
+	network, address := splitAddr(addr)
+
+	if o.HTTP2 && o.TLS == nil {
+		// h2c: HTTP/2 over a plain connection
+		return &http2.Transport{
+			AllowHTTP:       true,
+			IdleConnTimeout: o.IdleTimeout,
+			DialTLS: func(string, string, *tls.Config) (net.Conn, error) {
+				return net.Dial(network, address)
+			},
+		}
+	}
+
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+		MaxIdleConns:        o.MaxIdleConns,
+		MaxIdleConnsPerHost: o.MaxIdleConns,
+		IdleConnTimeout:     o.IdleTimeout,
+		TLSClientConfig:     o.TLS,
+		// A custom TLSClientConfig disables HTTP/2 otherwise
+		ForceAttemptHTTP2: o.HTTP2,
+	}
+}
+
+// loadTLSConfig returns the TLS configuration to connect to the caches,
+// verifying them with the CA certificates in caFile, or the system ones if
+// empty. The client certificate in certFile and keyFile, if any, is
+// presented to the caches.
+func loadTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoHandler checks the PURGE requests received, and answers with the
+// HTTP major version they were sent with.
+func protoHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assertEquals(t, req.Method, "PURGE")
+		assertEquals(t, req.Host, "en.wikipedia.org")
+		assertEquals(t, req.URL.Path, "/wiki/Main_Page")
+		rw.WriteHeader(200 + req.ProtoMajor)
+	})
+}
+
+func TestHTTPPurgerH2C(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(h2c.NewHandler(protoHandler(t), &http2.Server{}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	parsedURL, _ := url.Parse(server.URL)
+
+	status, err := NewHTTPPurger(parsedURL.Host, HTTPPurgerOptions{}).Send("en.wikipedia.org", "/wiki/Main_Page")
+	assertNotErr(t, err)
+	assertEquals(t, status, "201")
+	atomic.StoreInt32(&conns, 0)
+
+	// The purgers share the same connection
+	opts := HTTPPurgerOptions{HTTP2: true}
+	first, second := NewHTTPPurger(parsedURL.Host, opts), NewHTTPPurger(parsedURL.Host, opts)
+	assertEquals(t, first.client.Transport, second.client.Transport)
+
+	for _, client := range []*HTTPPurger{first, second} {
+		status, err = client.Send("en.wikipedia.org", "/wiki/Main_Page")
+		assertNotErr(t, err)
+		assertEquals(t, status, "202")
+	}
+
+	// Closing a purger leaves the shared connection open
+	assertNotErr(t, first.Close())
+	status, err = second.Send("en.wikipedia.org", "/wiki/Main_Page")
+	assertNotErr(t, err)
+	assertEquals(t, status, "202")
+	assertEquals(t, atomic.LoadInt32(&conns), int32(1))
+}
+
+// writeCA writes the certificate of server to a PEM file in dir.
+func writeCA(t *testing.T, dir string, server *httptest.Server) string {
+	path := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assertNotErr(t, ioutil.WriteFile(path, data, 0644))
+	return path
+}
+
+func TestHTTPPurgerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-nethttp")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewUnstartedServer(protoHandler(t))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	parsedURL, _ := url.Parse(server.URL)
+
+	cfg, err := loadTLSConfig(writeCA(t, dir, server), "", "", "example.com")
+	assertNotErr(t, err)
+
+	status, err := NewHTTPPurger(parsedURL.Host, HTTPPurgerOptions{TLS: cfg}).Send("en.wikipedia.org", "/wiki/Main_Page")
+	assertNotErr(t, err)
+	assertEquals(t, status, "201")
+
+	status, err = NewHTTPPurger(parsedURL.Host, HTTPPurgerOptions{TLS: cfg, HTTP2: true}).Send("en.wikipedia.org", "/wiki/Main_Page")
+	assertNotErr(t, err)
+	assertEquals(t, status, "202")
+
+	// Unknown CA
+	_, err = NewHTTPPurger(parsedURL.Host, HTTPPurgerOptions{TLS: &tls.Config{ServerName: "example.com"}}).Send("en.wikipedia.org", "/wiki/Main_Page")
+	expectErr(t, err)
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-nethttp")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = loadTLSConfig(filepath.Join(dir, "missing.pem"), "", "", "")
+	expectErr(t, err)
+
+	empty := filepath.Join(dir, "empty.pem")
+	assertNotErr(t, ioutil.WriteFile(empty, []byte("not a certificate\n"), 0644))
+	_, err = loadTLSConfig(empty, "", "", "")
+	expectErr(t, err)
+
+	// A client certificate without its key
+	_, err = loadTLSConfig("", empty, "", "")
+	expectErr(t, err)
+
+	cfg, err := loadTLSConfig("", "", "", "cp1001.eqiad.wmnet")
+	assertNotErr(t, err)
+	assertEquals(t, cfg.ServerName, "cp1001.eqiad.wmnet")
+	assertEquals(t, cfg.RootCAs == nil, true)
+}
@@ -0,0 +1,217 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	upperhex = "0123456789ABCDEF"
+
+	// Characters left unescaped in paths, besides the unreserved ones. As
+	// done by MediaWiki
+	pathSafe = ";:@$!*(),/"
+)
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// isPathSafe returns true if c does not need escaping in a path.
+func isPathSafe(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte(pathSafe, c) != -1
+}
+
+// isQuerySafe returns true if c does not need escaping in a query string.
+// Unlike paths, delimiters such as & and = are left alone.
+func isQuerySafe(c byte) bool {
+	return c > ' ' && c < 0x7f && c != '#' && c != '%'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// canonicalEscape returns s with a single escaping for each character. Bytes
+// for which safe returns false are escaped, with uppercase hex digits.
+// Escaped bytes for which unescape returns true are unescaped.
+func canonicalEscape(s string, safe func(byte) bool, unescape func(byte) bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if c == '%' && i+2 < len(s) {
+			hi, ok1 := unhex(s[i+1])
+			lo, ok2 := unhex(s[i+2])
+			if ok1 && ok2 {
+				decoded := hi<<4 | lo
+				if unescape(decoded) {
+					b.WriteByte(decoded)
+				} else {
+					b.WriteByte('%')
+					b.WriteByte(upperhex[decoded>>4])
+					b.WriteByte(upperhex[decoded&15])
+				}
+				i += 2
+				continue
+			}
+		}
+
+		if safe(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(upperhex[c>>4])
+			b.WriteByte(upperhex[c&15])
+		}
+	}
+
+	return b.String()
+}
+
+// Unescaping a slash would change the path
+func isPathUnescaped(c byte) bool {
+	return c != '/' && isPathSafe(c)
+}
+
+type hostVariant struct {
+	re       *regexp.Regexp
+	template string
+}
+
+// Normalizer canonicalizes purge URLs, so that all the ways of writing the
+// URL of an object result in the same purge, and expands purges into the
+// known variants of their hostname.
+type Normalizer struct {
+	variants []hostVariant
+}
+
+// NewNormalizer returns a Normalizer given a comma separated list of
+// regex=template host variants. For each hostname matching a regex, a purge
+// is also sent to the hostname given by expanding the template, eg:
+// ^([a-z]+)\.wikipedia\.org$=$1.m.wikipedia.org. Regexes are anchored, they
+// must match the whole hostname.
+func NewNormalizer(variants string) (*Normalizer, error) {
+	n := &Normalizer{}
+
+	for _, item := range strings.Split(variants, ",") {
+		if item == "" {
+			continue
+		}
+
+		i := strings.LastIndex(item, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("Invalid host variant %q, expected regex=template", item)
+		}
+
+		re, err := regexp.Compile("^(?:" + item[:i] + ")$")
+		if err != nil {
+			return nil, err
+		}
+
+		n.variants = append(n.variants, hostVariant{re: re, template: item[i+1:]})
+	}
+
+	return n, nil
+}
+
+// canonicalHost lowercases host and strips the port if it is the default one
+// for scheme.
+func canonicalHost(scheme, host string) string {
+	host = strings.ToLower(host)
+
+	h, port, err := net.SplitHostPort(host)
+	if err == nil && (scheme == "http" && port == "80" || scheme == "https" && port == "443") {
+		return h
+	}
+
+	return host
+}
+
+// canonicalURL returns the canonical form of rawURL.
+func canonicalURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL, err
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = canonicalHost(u.Scheme, u.Host)
+
+	escaped := canonicalEscape(u.EscapedPath(), isPathSafe, isPathUnescaped)
+	if u.Path, err = url.PathUnescape(escaped); err != nil {
+		return rawURL, err
+	}
+	u.RawPath = escaped
+
+	// Drop empty queries, such as a trailing ?
+	u.ForceQuery = false
+	u.RawQuery = canonicalEscape(u.RawQuery, isQuerySafe, isUnreserved)
+	u.Fragment = ""
+
+	return u.String(), nil
+}
+
+// Normalize returns the purges to send for p: p itself with a canonical URL,
+// followed by its host variants. URLs which cannot be parsed are left
+// unchanged.
+func (n *Normalizer) Normalize(p Purge) []Purge {
+	if n == nil {
+		return []Purge{p}
+	}
+
+	canonical, err := canonicalURL(p.URL)
+	if err != nil {
+		return []Purge{p}
+	}
+	p.URL = canonical
+
+	purges := []Purge{p}
+
+	u, _ := url.Parse(canonical)
+	host := u.Host
+	for _, v := range n.variants {
+		if !v.re.MatchString(host) {
+			continue
+		}
+
+		variant := p
+		u.Host = v.re.ReplaceAllString(host, v.template)
+		if u.Host == host {
+			continue
+		}
+		variant.URL = u.String()
+		purges = append(purges, variant)
+	}
+
+	return purges
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func assertCanonical(t *testing.T, rawURL, expected string) {
+	t.Helper()
+	canonical, err := canonicalURL(rawURL)
+	assertNotErr(t, err)
+	assertEquals(t, canonical, expected)
+}
+
+func TestCanonicalPercentEncoding(t *testing.T) {
+	expected := "http://es.wikipedia.org/api/rest_v1/page/html/Orquesta_de_Cadaqu%C3%A9s/125847869"
+
+	// Raw UTF-8
+	assertCanonical(t, "http://es.wikipedia.org/api/rest_v1/page/html/Orquesta_de_Cadaqués/125847869", expected)
+	// Lowercase escapes
+	assertCanonical(t, "http://es.wikipedia.org/api/rest_v1/page/html/Orquesta_de_Cadaqu%c3%a9s/125847869", expected)
+	// Already canonical
+	assertCanonical(t, expected, expected)
+
+	// Characters MediaWiki does not escape are unescaped, others are escaped
+	assertCanonical(t, "https://en.wikipedia.org/wiki/Foo_%28bar%29", "https://en.wikipedia.org/wiki/Foo_(bar)")
+	assertCanonical(t, "https://en.wikipedia.org/wiki/%41%7e", "https://en.wikipedia.org/wiki/A~")
+	assertCanonical(t, "https://en.wikipedia.org/wiki/Rock_'n'_roll", "https://en.wikipedia.org/wiki/Rock_%27n%27_roll")
+	// Slashes are left escaped
+	assertCanonical(t, "https://en.wikipedia.org/api/rest_v1/page/title/AC%2fDC", "https://en.wikipedia.org/api/rest_v1/page/title/AC%2FDC")
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	// Empty queries are dropped
+	assertCanonical(t, "https://en.wikipedia.org/wiki/Main_Page?", "https://en.wikipedia.org/wiki/Main_Page")
+
+	// Delimiters are left alone
+	assertCanonical(t, "https://en.wikipedia.org/w/index.php?title=Main_Page&action=history", "https://en.wikipedia.org/w/index.php?title=Main_Page&action=history")
+	assertCanonical(t, "https://en.wikipedia.org/w/index.php?title=AT%26T&action=raw", "https://en.wikipedia.org/w/index.php?title=AT%26T&action=raw")
+	assertCanonical(t, "https://en.wikipedia.org/w/index.php?title=Caf%c3%a9&%61ction=raw", "https://en.wikipedia.org/w/index.php?title=Caf%C3%A9&action=raw")
+}
+
+func TestCanonicalHost(t *testing.T) {
+	assertCanonical(t, "https://EN.Wikipedia.org:443/wiki/Main_Page", "https://en.wikipedia.org/wiki/Main_Page")
+	assertCanonical(t, "http://en.wikipedia.org:80/wiki/Main_Page", "http://en.wikipedia.org/wiki/Main_Page")
+	// Not the default port for the scheme
+	assertCanonical(t, "http://en.wikipedia.org:443/wiki/Main_Page", "http://en.wikipedia.org:443/wiki/Main_Page")
+	assertCanonical(t, "https://en.wikipedia.org:8443/wiki/Main_Page", "https://en.wikipedia.org:8443/wiki/Main_Page")
+}
+
+func TestCanonicalRequestURI(t *testing.T) {
+	// What backendWorker sends is the canonical path
+	canonical, _ := canonicalURL("http://es.wikipedia.org/wiki/Cadaqu%c3%a9s_%28Girona%29")
+	parsedURL, _ := url.Parse(canonical)
+	assertEquals(t, parsedURL.RequestURI(), "/wiki/Cadaqu%C3%A9s_(Girona)")
+}
+
+func TestNormalizeVariants(t *testing.T) {
+	_, err := NewNormalizer(`^([a-z]+)\.wikipedia\.org$`)
+	expectErr(t, err)
+	_, err = NewNormalizer(`^([a-z]+\.wikipedia\.org$=$1.m.wikipedia.org`)
+	expectErr(t, err)
+
+	n, err := NewNormalizer(`^([a-z]+)\.wikipedia\.org$=$1.m.wikipedia.org,^www\.wikidata\.org$=m.wikidata.org`)
+	assertNotErr(t, err)
+
+	purges := n.Normalize(Purge{URL: "https://EN.wikipedia.org/wiki/Main_Page?", Source: kafkaValue})
+	assertEquals(t, len(purges), 2)
+	assertEquals(t, purges[0].URL, "https://en.wikipedia.org/wiki/Main_Page")
+	assertEquals(t, purges[1].URL, "https://en.m.wikipedia.org/wiki/Main_Page")
+	assertEquals(t, purges[1].Source, kafkaValue)
+
+	purges = n.Normalize(Purge{URL: "https://www.wikidata.org/wiki/Q42"})
+	assertEquals(t, len(purges), 2)
+	assertEquals(t, purges[1].URL, "https://m.wikidata.org/wiki/Q42")
+
+	// Mobile hostnames do not match
+	purges = n.Normalize(Purge{URL: "https://en.m.wikipedia.org/wiki/Main_Page"})
+	assertEquals(t, len(purges), 1)
+
+	// Regexes match whole hostnames
+	n, err = NewNormalizer(`wikipedia\.org=wikipedia.com`)
+	assertNotErr(t, err)
+	assertEquals(t, len(n.Normalize(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"})), 1)
+	purges = n.Normalize(Purge{URL: "https://wikipedia.org/"})
+	assertEquals(t, len(purges), 2)
+	assertEquals(t, purges[1].URL, "https://wikipedia.com/")
+
+	// Without a Normalizer, purges are left unchanged
+	purges = (*Normalizer)(nil).Normalize(Purge{URL: "https://EN.wikipedia.org/wiki/Main_Page?"})
+	assertEquals(t, purges[0].URL, "https://EN.wikipedia.org/wiki/Main_Page?")
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const partitionLabel = "partition"
+
+var (
+	processedOffset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "purged_kafka_processed_offset",
+		Help: "Offset up to which all Kafka messages have been processed, by topic and partition",
+	}, []string{
+		topicLabel,
+		partitionLabel,
+	})
+)
+
+// TopicPartition identifies a Kafka partition.
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// partitionOffsets are the offsets of the messages of a partition being
+// processed, in the order they were read.
+type partitionOffsets struct {
+	offsets []int64
+	// Number of purges being processed for each offset
+	pending map[int64]int
+	// Offset of the next message to process, once all previous ones are
+	// done, and whether it changed since last returned by Processed
+	next    int64
+	changed bool
+}
+
+// OffsetTracker keeps track of the Kafka messages whose purges are being
+// processed, so that offsets are only committed once all purges read up to
+// them have been sent to the caches, discarded, or persisted in the spool. A
+// nil OffsetTracker tracks nothing.
+type OffsetTracker struct {
+	mutex      sync.Mutex
+	partitions map[TopicPartition]*partitionOffsets
+}
+
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{partitions: make(map[TopicPartition]*partitionOffsets)}
+}
+
+// Track returns p marked as being processed, if it was read from Kafka.
+// Purges must be tracked in the order they were read from each partition.
+func (t *OffsetTracker) Track(p Purge) Purge {
+	if t == nil || p.Source != kafkaValue || p.Topic == "" {
+		return p
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	tp := TopicPartition{p.Topic, p.Partition}
+	po, ok := t.partitions[tp]
+	if !ok {
+		po = &partitionOffsets{pending: make(map[int64]int)}
+		t.partitions[tp] = po
+	}
+
+	if n := len(po.offsets); n == 0 || po.offsets[n-1] != p.Offset {
+		po.offsets = append(po.offsets, p.Offset)
+	}
+	po.pending[p.Offset]++
+
+	p.offsets = t
+	return p
+}
+
+// Done marks p as processed.
+func (t *OffsetTracker) Done(p Purge) {
+	if t == nil || p.offsets != t {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	po, ok := t.partitions[TopicPartition{p.Topic, p.Partition}]
+	if !ok || po.pending[p.Offset] == 0 {
+		return
+	}
+
+	po.pending[p.Offset]--
+	if po.pending[p.Offset] > 0 {
+		return
+	}
+	delete(po.pending, p.Offset)
+
+	for len(po.offsets) > 0 && po.pending[po.offsets[0]] == 0 {
+		po.next = po.offsets[0] + 1
+		po.changed = true
+		po.offsets = po.offsets[1:]
+	}
+}
+
+// Pending returns the number of purges being processed.
+func (t *OffsetTracker) Pending() int {
+	if t == nil {
+		return 0
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := 0
+	for _, po := range t.partitions {
+		for _, pending := range po.pending {
+			n += pending
+		}
+	}
+	return n
+}
+
+// Processed returns, for each partition, the offset of the next message to
+// process if it changed since the previous call.
+func (t *OffsetTracker) Processed() map[TopicPartition]int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	offsets := make(map[TopicPartition]int64)
+	for tp, po := range t.partitions {
+		if !po.changed {
+			continue
+		}
+
+		offsets[tp] = po.next
+		po.changed = false
+		processedOffset.With(prometheus.Labels{
+			topicLabel:     tp.Topic,
+			partitionLabel: strconv.Itoa(int(tp.Partition)),
+		}).Set(float64(po.next))
+	}
+	return offsets
+}
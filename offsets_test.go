@@ -0,0 +1,160 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func kafkaPurge(partition int32, offset int64) Purge {
+	return Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue, Topic: "eqiad.resource-purge", Partition: partition, Offset: offset}
+}
+
+func TestOffsetTracker(t *testing.T) {
+	tracker := NewOffsetTracker()
+	tp := TopicPartition{"eqiad.resource-purge", 0}
+
+	var purges []Purge
+	for offset := int64(10); offset < 13; offset++ {
+		purges = append(purges, tracker.Track(kafkaPurge(0, offset)))
+	}
+	assertEquals(t, len(tracker.Processed()), 0)
+
+	// Processed out of order
+	tracker.Done(purges[1])
+	assertEquals(t, len(tracker.Processed()), 0)
+
+	tracker.Done(purges[0])
+	processed := tracker.Processed()
+	assertEquals(t, len(processed), 1)
+	assertEquals(t, processed[tp], int64(12))
+
+	// Unchanged
+	assertEquals(t, len(tracker.Processed()), 0)
+
+	// Done twice
+	tracker.Done(purges[0])
+	assertEquals(t, len(tracker.Processed()), 0)
+
+	tracker.Done(purges[2])
+	assertEquals(t, tracker.Processed()[tp], int64(13))
+}
+
+func TestOffsetTrackerVariants(t *testing.T) {
+	tracker := NewOffsetTracker()
+	tp := TopicPartition{"eqiad.resource-purge", 1}
+
+	// Host variants of the same message
+	desktop := tracker.Track(kafkaPurge(1, 5))
+	mobile := tracker.Track(kafkaPurge(1, 5))
+	other := tracker.Track(kafkaPurge(2, 5))
+
+	tracker.Done(desktop)
+	assertEquals(t, len(tracker.Processed()), 0)
+
+	tracker.Done(mobile)
+	processed := tracker.Processed()
+	assertEquals(t, len(processed), 1)
+	assertEquals(t, processed[tp], int64(6))
+
+	tracker.Done(other)
+	assertEquals(t, tracker.Processed()[TopicPartition{"eqiad.resource-purge", 2}], int64(6))
+}
+
+// finishingQueue is a Queue sending purges right away, recording how many
+// partitions have processed offsets after each.
+type finishingQueue struct {
+	tracker   *OffsetTracker
+	processed []int
+}
+
+func (q *finishingQueue) Push(p Purge) {
+	finishPurge(p, sentResult)
+	q.processed = append(q.processed, len(q.tracker.Processed()))
+}
+
+func (q *finishingQueue) TryPush(p Purge) bool {
+	q.Push(p)
+	return true
+}
+
+func (q *finishingQueue) DropOldest(p Purge) bool {
+	return false
+}
+
+// The message is processed once all of its host variants are
+func TestIngressOffsetsVariants(t *testing.T) {
+	normalizer, err := NewNormalizer(`^([a-z]+)\.wikipedia\.org$=$1.m.wikipedia.org`)
+	assertNotErr(t, err)
+
+	queue := &finishingQueue{tracker: NewOffsetTracker()}
+	in, err := NewIngress(kafkaValue, nil, queue, nil)
+	assertNotErr(t, err)
+	in.Normalizer = normalizer
+	in.Offsets = queue.tracker
+
+	chin := make(chan Purge, 1)
+	chin <- kafkaPurge(0, 7)
+	close(chin)
+	in.Run(chin)
+
+	assertEquals(t, len(queue.processed), 2)
+	assertEquals(t, queue.processed[0], 0)
+	assertEquals(t, queue.processed[1], 1)
+}
+
+func TestOffsetTrackerUntracked(t *testing.T) {
+	tracker := NewOffsetTracker()
+
+	p := tracker.Track(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: multicastValue})
+	assertEquals(t, p.offsets == nil, true)
+
+	// Read back from the spool
+	tracker.Done(kafkaPurge(0, 1))
+	assertEquals(t, len(tracker.Processed()), 0)
+
+	// Without a tracker
+	p = (*OffsetTracker)(nil).Track(kafkaPurge(0, 1))
+	assertEquals(t, p.offsets == nil, true)
+	(*OffsetTracker)(nil).Done(p)
+}
+
+func TestOffsetsDropped(t *testing.T) {
+	tracker := NewOffsetTracker()
+
+	q := make(chanQueue, 1)
+	q.Push(tracker.Track(kafkaPurge(0, 7)))
+	assertEquals(t, q.DropOldest(Purge{}), true)
+
+	assertEquals(t, tracker.Processed()[TopicPartition{"eqiad.resource-purge", 0}], int64(8))
+}
+
+func TestStoreOffsets(t *testing.T) {
+	kr, mr := setupKafkaReaderTest(nil, false)
+	kr.Offsets = NewOffsetTracker()
+
+	kr.Offsets.Done(kr.Offsets.Track(kafkaPurge(4, 41)))
+	kr.storeOffsets()
+	assertEquals(t, len(mr.Stored), 1)
+	assertEquals(t, *mr.Stored[0].Topic, "eqiad.resource-purge")
+	assertEquals(t, mr.Stored[0].Partition, int32(4))
+	assertEquals(t, int64(mr.Stored[0].Offset), int64(42))
+
+	// Nothing new to store
+	kr.storeOffsets()
+	assertEquals(t, len(mr.Stored), 1)
+}
@@ -0,0 +1,257 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	overflowBlock      = "block"
+	overflowDropNewest = "drop-newest"
+	overflowDropOldest = "drop-oldest"
+	overflowSpill      = "spill"
+
+	sourceLabel    = "source"
+	multicastValue = "multicast"
+	kafkaValue     = "kafka"
+	httpValue      = "http"
+
+	// Buffer between each reader and its Ingress
+	sourceBufferLen = 1000
+)
+
+var (
+	droppedPurges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged_dropped_total",
+		Help: "Total number of purges dropped because the backend queue was full",
+	}, []string{
+		sourceLabel,
+	})
+	spilledPurges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged_spilled_total",
+		Help: "Total number of purges spilled to disk because the backend queue was full",
+	}, []string{
+		sourceLabel,
+	})
+	blockedSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged_blocked_seconds_total",
+		Help: "Total time spent waiting for room in the backend queue, in seconds",
+	}, []string{
+		sourceLabel,
+	})
+
+	spillErrorLog = spoolLog.Limited()
+)
+
+// parseOverflowPolicies parses the -overflow_policy flag: either a single
+// policy applying to all sources, or a comma separated list of source:policy
+// pairs. Sources not listed use the block policy.
+func parseOverflowPolicies(value string) (map[string]string, error) {
+	policies := make(map[string]string)
+
+	for _, item := range strings.Split(value, ",") {
+		if item == "" {
+			continue
+		}
+
+		source, policy := "", item
+		if i := strings.Index(item, ":"); i != -1 {
+			source, policy = item[:i], item[i+1:]
+		}
+
+		switch policy {
+		case overflowBlock, overflowDropNewest, overflowDropOldest, overflowSpill:
+		default:
+			return nil, fmt.Errorf("Unknown overflow policy %q", policy)
+		}
+
+		policies[source] = policy
+	}
+
+	return policies, nil
+}
+
+// Ingress forwards the purges read from a source to the backend queue,
+// applying the source's overflow policy when the queue is full.
+type Ingress struct {
+	source string
+	policy string
+	out    Queue
+	spool  *PrioritySpool
+
+	// URL normalization and rules applied before queueing, if any
+	Normalizer *Normalizer
+	Rules      *RuleEngine
+	// Tracker of the Kafka offsets of the purges, if any
+	Offsets *OffsetTracker
+	// Audit log of the purges, if any
+	AuditLog *AuditLog
+	// Which bans are allowed, once normalized and rewritten by the rules
+	BanGuard *BanGuard
+
+	// While paused, Run stops consuming from the source
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+// NewIngress returns an Ingress for source. The spill policy requires spool
+// to be non-nil.
+func NewIngress(source string, policies map[string]string, out Queue, spool *PrioritySpool) (*Ingress, error) {
+	policy, ok := policies[source]
+	if !ok {
+		policy, ok = policies[""]
+	}
+	if !ok {
+		policy = overflowBlock
+	}
+
+	if policy == overflowSpill && spool == nil {
+		return nil, fmt.Errorf("The %s overflow policy of %s requires -spill_dir", policy, source)
+	}
+
+	i := &Ingress{source: source, policy: policy, out: out, spool: spool}
+	i.cond = sync.NewCond(&i.mutex)
+	return i, nil
+}
+
+// Pause stops consumption from the source until Resume is called.
+func (i *Ingress) Pause() {
+	i.mutex.Lock()
+	i.paused = true
+	i.mutex.Unlock()
+}
+
+func (i *Ingress) Resume() {
+	i.mutex.Lock()
+	i.paused = false
+	i.cond.Broadcast()
+	i.mutex.Unlock()
+}
+
+func (i *Ingress) Paused() bool {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.paused
+}
+
+// waitResumed blocks while the Ingress is paused.
+func (i *Ingress) waitResumed() {
+	i.mutex.Lock()
+	for i.paused {
+		i.cond.Wait()
+	}
+	i.mutex.Unlock()
+}
+
+// Put sends p to the backend queue.
+func (i *Ingress) Put(p Purge) {
+	if i.out.TryPush(p) {
+		return
+	}
+
+	// The queue is full
+	labels := prometheus.Labels{sourceLabel: i.source}
+
+	switch i.policy {
+	case overflowDropNewest:
+		droppedPurges.With(labels).Inc()
+		finishPurge(p, droppedResult)
+	case overflowDropOldest:
+		for !i.out.TryPush(p) {
+			if i.out.DropOldest(p) {
+				droppedPurges.With(labels).Inc()
+			}
+		}
+	case overflowSpill:
+		if err := i.spool.PutPurge(p); err != nil {
+			droppedPurges.With(labels).Inc()
+			finishPurge(p, droppedResult)
+			if err != errSpoolFull {
+				spillErrorLog.Error("Error spilling purge to disk", "source", i.source, "err", err)
+			}
+			return
+		}
+		spilledPurges.With(labels).Inc()
+	default:
+		start := time.Now()
+		i.out.Push(p)
+		blockedSeconds.With(labels).Add(time.Since(start).Seconds())
+	}
+}
+
+// checkBan returns true if the ban requested by p is allowed. Host variants
+// and rules might have changed its host since it was read.
+func (i *Ingress) checkBan(p Purge) bool {
+	parsedURL, err := url.Parse(p.URL)
+	if err == nil {
+		err = i.BanGuard.Check(parsedURL.Host, p.Pattern)
+	}
+	if err != nil {
+		banRejectedLog.Warn("Rejecting ban", "source", i.source, "url", p.URL, "pattern", p.Pattern, "err", err)
+		return false
+	}
+	return true
+}
+
+// Run forwards all purges received on chin to the backend queue. While the
+// Ingress is paused, purges are left on chin, so that the reader eventually
+// blocks.
+func (i *Ingress) Run(chin chan Purge) {
+	for {
+		i.waitResumed()
+
+		p, ok := <-chin
+		if !ok {
+			return
+		}
+
+		if p.Received.IsZero() {
+			p.Received = time.Now()
+		}
+
+		// Track all variants before queueing any, so that the message is
+		// not considered processed once only some of them are
+		purges := i.Normalizer.Normalize(p)
+		for j := range purges {
+			purges[j] = i.Offsets.Track(purges[j])
+		}
+
+		for _, p := range purges {
+			p.Audit = i.AuditLog.Start(p)
+			p.Trace = tracer.Start(p)
+			p, ok = i.Rules.Apply(p)
+			if ok && p.Kind == banKind {
+				ok = i.checkBan(p)
+			}
+			if ok {
+				tracer.Stage(p, "", "ingress", consumerSpan, time.Time{}, time.Now(), nil, "purged.source", p.Source)
+				i.Put(p)
+			} else {
+				finishPurge(p, deniedResult)
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseOverflowPolicies(t *testing.T) {
+	policies, err := parseOverflowPolicies("drop-newest")
+	assertNotErr(t, err)
+	assertEquals(t, policies[""], overflowDropNewest)
+
+	policies, err = parseOverflowPolicies("multicast:drop-oldest,kafka:block")
+	assertNotErr(t, err)
+	assertEquals(t, policies[multicastValue], overflowDropOldest)
+	assertEquals(t, policies[kafkaValue], overflowBlock)
+
+	_, err = parseOverflowPolicies("multicast:explode")
+	expectErr(t, err)
+}
+
+func TestNewIngress(t *testing.T) {
+	policies, _ := parseOverflowPolicies("multicast:spill")
+	out := make(chanQueue, 1)
+
+	ing, err := NewIngress(kafkaValue, policies, out, nil)
+	assertNotErr(t, err)
+	assertEquals(t, ing.policy, overflowBlock)
+
+	// Spilling requires a spool
+	_, err = NewIngress(multicastValue, policies, out, nil)
+	expectErr(t, err)
+}
+
+func TestIngressDropNewest(t *testing.T) {
+	out := make(chanQueue, 1)
+	ing, _ := NewIngress(multicastValue, map[string]string{"": overflowDropNewest}, out, nil)
+
+	ing.Put(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"})
+	ing.Put(Purge{URL: "https://it.wikipedia.org/wiki/Pagina_principale"})
+
+	assertEquals(t, len(out), 1)
+	assertEquals(t, (<-out).URL, "https://en.wikipedia.org/wiki/Main_Page")
+}
+
+func TestIngressDropOldest(t *testing.T) {
+	out := make(chanQueue, 1)
+	ing, _ := NewIngress(multicastValue, map[string]string{"": overflowDropOldest}, out, nil)
+
+	ing.Put(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"})
+	ing.Put(Purge{URL: "https://it.wikipedia.org/wiki/Pagina_principale"})
+
+	assertEquals(t, len(out), 1)
+	assertEquals(t, (<-out).URL, "https://it.wikipedia.org/wiki/Pagina_principale")
+}
+
+func TestIngressSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-spool")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, _ := NewPriorityQueue("normal:1", "", "normal", 10)
+	spool, err := NewPrioritySpool(dir, 1<<20, 1<<10, spoolDropNewest, queue)
+	assertNotErr(t, err)
+	defer spool.Close()
+
+	out := make(chanQueue, 1)
+	ing, err := NewIngress(kafkaValue, map[string]string{kafkaValue: overflowSpill}, out, spool)
+	assertNotErr(t, err)
+
+	ing.Put(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"})
+	ing.Put(Purge{URL: "https://it.wikipedia.org/wiki/Pagina_principale"})
+
+	assertEquals(t, (<-out).URL, "https://en.wikipedia.org/wiki/Main_Page")
+	p, err := spool.spools["normal"].GetPurge()
+	assertNotErr(t, err)
+	assertEquals(t, p.URL, "https://it.wikipedia.org/wiki/Pagina_principale")
+}
+
+func TestIngressBlock(t *testing.T) {
+	out := make(chanQueue, 1)
+	ing, _ := NewIngress(kafkaValue, map[string]string{}, out, nil)
+
+	chin := make(chan Purge, 2)
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+	chin <- Purge{URL: "https://it.wikipedia.org/wiki/Pagina_principale"}
+	close(chin)
+
+	done := make(chan struct{})
+	go func() {
+		ing.Run(chin)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Ingress did not block on a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assertEquals(t, (<-out).URL, "https://en.wikipedia.org/wiki/Main_Page")
+	<-done
+	assertEquals(t, (<-out).URL, "https://it.wikipedia.org/wiki/Pagina_principale")
+}
+
+func TestIngressPause(t *testing.T) {
+	out := make(chanQueue, 10)
+	ing, _ := NewIngress(kafkaValue, map[string]string{}, out, nil)
+
+	chin := make(chan Purge, 10)
+	go ing.Run(chin)
+
+	ing.Pause()
+	// Let Run wait for the Ingress to be resumed
+	time.Sleep(100 * time.Millisecond)
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+	time.Sleep(100 * time.Millisecond)
+	assertEquals(t, len(out), 0)
+	assertEquals(t, len(chin), 1)
+
+	ing.Resume()
+	assertEquals(t, (<-out).URL, "https://en.wikipedia.org/wiki/Main_Page")
+	close(chin)
+}
+
+// Bans are checked again once normalized
+func TestIngressBanGuard(t *testing.T) {
+	out := make(chanQueue, 10)
+	ing, _ := NewIngress(kafkaValue, map[string]string{}, out, nil)
+	ing.BanGuard = &BanGuard{Hosts: regexp.MustCompile(`^upload\.wikimedia\.org$`), MinPrefix: 10}
+	normalizer, err := NewNormalizer(`upload\.wikimedia\.org=upload.wikipedia.org`)
+	assertNotErr(t, err)
+	ing.Normalizer = normalizer
+
+	chin := make(chan Purge, 10)
+	chin <- Purge{URL: "https://upload.wikimedia.org/", Kind: banKind, Pattern: "^/wikipedia/commons/thumb/"}
+	close(chin)
+	ing.Run(chin)
+
+	assertEquals(t, len(out), 1)
+	assertEquals(t, (<-out).URL, "https://upload.wikimedia.org/")
+}
@@ -0,0 +1,310 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const priorityLabel = "priority"
+
+// Queue is a bounded queue of purges waiting to be processed.
+type Queue interface {
+	// Push adds p to the queue, waiting for room if the queue is full
+	Push(p Purge)
+	// TryPush adds p to the queue, returning false if the queue is full
+	TryPush(p Purge) bool
+	// DropOldest discards the oldest purge queued where p would be queued,
+	// returning false if there is none
+	DropOldest(p Purge) bool
+}
+
+// chanQueue is a Queue backed by a plain buffered channel.
+type chanQueue chan Purge
+
+func (q chanQueue) Push(p Purge) {
+	q <- p
+}
+
+func (q chanQueue) TryPush(p Purge) bool {
+	select {
+	case q <- p:
+		return true
+	default:
+		return false
+	}
+}
+
+func (q chanQueue) DropOldest(p Purge) bool {
+	select {
+	case dropped := <-q:
+		finishPurge(dropped, droppedResult)
+		return true
+	default:
+		return false
+	}
+}
+
+// priorityRule assigns the purges matching a source, Kafka topic, tag or
+// host pattern to a priority class.
+type priorityRule struct {
+	field string
+	value string
+	re    *regexp.Regexp
+	class string
+}
+
+func (r priorityRule) match(p Purge) bool {
+	switch r.field {
+	case "source":
+		return p.Source == r.value
+	case "topic":
+		return p.Topic == r.value
+	case "tag":
+		for _, tag := range p.Tags {
+			if tag == r.value {
+				return true
+			}
+		}
+	case "host":
+		parsedURL, err := url.Parse(p.URL)
+		return err == nil && r.re.MatchString(parsedURL.Host)
+	}
+	return false
+}
+
+type priorityClass struct {
+	name   string
+	weight int
+	ch     chan Purge
+	// Smooth weighted round-robin state
+	current int
+}
+
+// PriorityQueue holds purges in several priority classes. Purges are
+// dequeued with weighted-fair scheduling: as long as they have purges
+// queued, each class gets a share of the workers proportional to its weight.
+type PriorityQueue struct {
+	classes  []*priorityClass
+	byName   map[string]*priorityClass
+	rules    []priorityRule
+	fallback *priorityClass
+	notify   chan struct{}
+	// Number of purges dequeued but not yet taken by a worker
+	held int32
+}
+
+// NewPriorityQueue returns a PriorityQueue given a comma separated list of
+// class:weight pairs, a comma separated list of field=value:class rules
+// (field being one of source, topic, tag or host) and the class of the
+// purges matching no rule. Each class can hold up to size purges.
+func NewPriorityQueue(classes, rules, fallback string, size int) (*PriorityQueue, error) {
+	q := &PriorityQueue{byName: make(map[string]*priorityClass), notify: make(chan struct{}, 1)}
+
+	for _, item := range strings.Split(classes, ",") {
+		i := strings.LastIndex(item, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("Invalid priority class %q, expected name:weight", item)
+		}
+
+		weight, err := strconv.Atoi(item[i+1:])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("Invalid weight for priority class %q", item)
+		}
+
+		class := &priorityClass{name: item[:i], weight: weight, ch: make(chan Purge, size)}
+		q.classes = append(q.classes, class)
+		q.byName[class.name] = class
+	}
+
+	for _, item := range strings.Split(rules, ",") {
+		if item == "" {
+			continue
+		}
+
+		eq := strings.Index(item, "=")
+		colon := strings.LastIndex(item, ":")
+		if eq == -1 || colon < eq {
+			return nil, fmt.Errorf("Invalid priority rule %q, expected field=value:class", item)
+		}
+
+		rule := priorityRule{field: item[:eq], value: item[eq+1 : colon], class: item[colon+1:]}
+		switch rule.field {
+		case "source", "topic", "tag":
+		case "host":
+			re, err := regexp.Compile(rule.value)
+			if err != nil {
+				return nil, err
+			}
+			rule.re = re
+		default:
+			return nil, fmt.Errorf("Invalid priority rule %q, unknown field %s", item, rule.field)
+		}
+
+		if _, ok := q.byName[rule.class]; !ok {
+			return nil, fmt.Errorf("Priority rule %q refers to unknown class %s", item, rule.class)
+		}
+
+		q.rules = append(q.rules, rule)
+	}
+
+	var ok bool
+	if q.fallback, ok = q.byName[fallback]; !ok {
+		return nil, fmt.Errorf("Unknown default priority class %s", fallback)
+	}
+
+	return q, nil
+}
+
+// Classify returns the priority class of p, given by the first matching
+// rule.
+func (q *PriorityQueue) Classify(p Purge) string {
+	return q.class(p).name
+}
+
+func (q *PriorityQueue) class(p Purge) *priorityClass {
+	for _, rule := range q.rules {
+		if rule.match(p) {
+			return q.byName[rule.class]
+		}
+	}
+	return q.fallback
+}
+
+func (q *PriorityQueue) wakeup() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *PriorityQueue) Push(p Purge) {
+	p.queued = time.Now()
+	q.class(p).ch <- p
+	q.wakeup()
+}
+
+func (q *PriorityQueue) TryPush(p Purge) bool {
+	p.queued = time.Now()
+	select {
+	case q.class(p).ch <- p:
+		q.wakeup()
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *PriorityQueue) DropOldest(p Purge) bool {
+	select {
+	case dropped := <-q.class(p).ch:
+		finishPurge(dropped, droppedResult)
+		return true
+	default:
+		return false
+	}
+}
+
+// Len returns the number of purges queued in each class.
+func (q *PriorityQueue) Len() map[string]int {
+	lens := make(map[string]int, len(q.classes))
+	for _, class := range q.classes {
+		lens[class.name] = len(class.ch)
+	}
+	return lens
+}
+
+// Pending returns the number of purges queued or dequeued but not yet taken
+// by a worker.
+func (q *PriorityQueue) Pending() int {
+	n := int(atomic.LoadInt32(&q.held))
+	for _, class := range q.classes {
+		n += len(class.ch)
+	}
+	return n
+}
+
+// Drain discards all queued purges, returning how many.
+func (q *PriorityQueue) Drain() int {
+	n := 0
+	for _, class := range q.classes {
+		for done := false; !done; {
+			select {
+			case p := <-class.ch:
+				finishPurge(p, droppedResult)
+				n++
+			default:
+				done = true
+			}
+		}
+	}
+	return n
+}
+
+// next picks the class to dequeue from among those with purges queued,
+// using smooth weighted round-robin. It returns nil if all classes are
+// empty.
+func (q *PriorityQueue) next() *priorityClass {
+	var best *priorityClass
+	total := 0
+
+	for _, class := range q.classes {
+		if len(class.ch) == 0 {
+			continue
+		}
+
+		class.current += class.weight
+		total += class.weight
+		if best == nil || class.current > best.current {
+			best = class
+		}
+	}
+
+	if best != nil {
+		best.current -= total
+	}
+
+	return best
+}
+
+// Run dequeues purges and sends them to chout for consumption by the
+// backend workers.
+func (q *PriorityQueue) Run(chout chan Purge) {
+	for {
+		class := q.next()
+		if class == nil {
+			<-q.notify
+			continue
+		}
+
+		select {
+		case p := <-class.ch:
+			atomic.AddInt32(&q.held, 1)
+			chout <- p
+			atomic.AddInt32(&q.held, -1)
+			observeQueued(backendValue, class.name, p, time.Now())
+		default:
+			// Emptied by DropOldest in the meantime
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestNewPriorityQueueErrors(t *testing.T) {
+	_, err := NewPriorityQueue("urgent", "", "urgent", 10)
+	expectErr(t, err)
+
+	_, err = NewPriorityQueue("urgent:0", "", "urgent", 10)
+	expectErr(t, err)
+
+	_, err = NewPriorityQueue("urgent:2,normal:1", "", "bulk", 10)
+	expectErr(t, err)
+
+	_, err = NewPriorityQueue("urgent:2,normal:1", "tag=test:bulk", "normal", 10)
+	expectErr(t, err)
+
+	_, err = NewPriorityQueue("urgent:2,normal:1", "path=/wiki:urgent", "normal", 10)
+	expectErr(t, err)
+
+	_, err = NewPriorityQueue("urgent:2,normal:1", "host=[:urgent", "normal", 10)
+	expectErr(t, err)
+}
+
+func TestPriorityClassify(t *testing.T) {
+	q, err := NewPriorityQueue("urgent:10,normal:5,bulk:1",
+		"source=multicast:urgent,topic=codfw.resource-purge:normal,tag=transcludes:bulk,host=^upload\\.:urgent",
+		"normal", 10)
+	assertNotErr(t, err)
+
+	assertEquals(t, q.Classify(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: multicastValue}), "urgent")
+	assertEquals(t, q.Classify(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue, Topic: "codfw.resource-purge", Tags: []string{"transcludes"}}), "normal")
+	assertEquals(t, q.Classify(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue, Tags: []string{"templates", "transcludes"}}), "bulk")
+	assertEquals(t, q.Classify(Purge{URL: "https://upload.wikimedia.org/a/a9/Example.jpg", Source: kafkaValue}), "urgent")
+	assertEquals(t, q.Classify(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue}), "normal")
+}
+
+// Each class gets a share of the dequeued purges proportional to its weight
+func TestPriorityWeightedFair(t *testing.T) {
+	q, err := NewPriorityQueue("urgent:3,bulk:1", "tag=urgent:urgent", "bulk", 100)
+	assertNotErr(t, err)
+
+	for i := 0; i < 40; i++ {
+		q.Push(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Tags: []string{"urgent"}})
+		q.Push(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"})
+	}
+
+	lens := q.Len()
+	assertEquals(t, lens["urgent"], 40)
+	assertEquals(t, lens["bulk"], 40)
+
+	chout := make(chan Purge)
+	go q.Run(chout)
+
+	urgent := 0
+	for i := 0; i < 40; i++ {
+		p := <-chout
+		if len(p.Tags) > 0 {
+			urgent++
+		}
+	}
+	assertEquals(t, urgent, 30)
+
+	// Once a class is empty, the others get all the workers
+	for i := 0; i < 40; i++ {
+		<-chout
+	}
+	lens = q.Len()
+	assertEquals(t, lens["urgent"], 0)
+	assertEquals(t, lens["bulk"], 0)
+}
+
+func TestPriorityTryPush(t *testing.T) {
+	q, _ := NewPriorityQueue("urgent:3,bulk:1", "source=multicast:urgent", "bulk", 1)
+
+	assertEquals(t, q.TryPush(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: multicastValue}), true)
+	assertEquals(t, q.TryPush(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: multicastValue}), false)
+	// Other classes are unaffected
+	assertEquals(t, q.TryPush(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue}), true)
+
+	assertEquals(t, q.DropOldest(Purge{Source: multicastValue}), true)
+	assertEquals(t, q.DropOldest(Purge{Source: multicastValue}), false)
+	assertEquals(t, q.Len()["bulk"], 1)
+}
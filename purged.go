@@ -33,6 +33,8 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -41,22 +43,71 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// Purge is a URL to be purged, along with the information about where it
+// comes from needed to prioritize it.
+type Purge struct {
+	URL    string
+	Source string
+	// Kind is empty for exact URL purges, banKind to invalidate all objects
+	// of the URL host with a path matching Pattern, or xkeyKind to invalidate
+	// all objects of the URL host tagged with any of Keys
+	Kind    string   `json:",omitempty"`
+	Pattern string   `json:",omitempty"`
+	Keys    []string `json:",omitempty"`
+	// Kafka topic and event tags, if any
+	Topic string   `json:",omitempty"`
+	Tags  []string `json:",omitempty"`
+	// Layer is empty to purge both layers, or either backendValue or
+	// frontendValue to purge only that one
+	Layer string `json:",omitempty"`
+	// When purged received the purge, and the timestamp of the event it was
+	// read from, if any
+	Received  time.Time
+	EventTime time.Time
+	// Identifiers of the event the purge was read from, if any
+	EventID   string `json:",omitempty"`
+	RequestID string `json:",omitempty"`
+	// Kafka partition and offset of the message the purge was read from
+	Partition int32 `json:",omitempty"`
+	Offset    int64 `json:",omitempty"`
+	// History of the purge, if sampled for the audit log
+	Audit *AuditRecord `json:",omitempty"`
+	// Trace of the purge, if sampled for tracing
+	Trace *Trace `json:",omitempty"`
+	// When the purge was queued for the backend or frontend workers
+	queued time.Time
+	// Tracker of the Kafka offset of the purge, if any
+	offsets *OffsetTracker
+	// Number of failed attempts at sending the purge to the current layer
+	attempts int
+}
+
 type PurgeClient interface {
-	Send(host, uri string) (string, error) // return status code and error (if any)
+	Send(host, uri string) (string, error)                // return status code and error (if any)
+	Ban(host, pattern string) (string, error)             // return status code and error (if any)
+	PurgeKeys(host string, keys []string) (string, error) // return status code and error (if any)
+	Close() error
 }
 
 type TCPPurger struct {
-	conn     net.Conn
-	destAddr string
+	conn       net.Conn
+	destAddr   string
+	xkeyHeader string
+	template   *RequestTemplate
 }
 
 type HTTPPurger struct {
-	client   http.Client
-	destAddr string
+	client     http.Client
+	baseURL    string
+	destAddr   string
+	xkeyHeader string
+	template   *RequestTemplate
+	// Whether the connections to the cache are shared with other HTTPPurgers
+	shared bool
 }
 
 const (
-	purgeReq           = "PURGE %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: purged\r\n\r\n"
+	banReq             = "BAN / HTTP/1.1\r\nHost: %s\r\n" + banHeader + ": %s\r\nUser-Agent: purged\r\n%s\r\n"
 	connectionAttempts = 16
 	sendAttempts       = 10
 	bufferLen          = 1000000
@@ -68,21 +119,94 @@ const (
 )
 
 var (
-	frontendAddr     = flag.String("frontend_addr", "127.0.0.1:80", "Cache frontend address")
-	backendAddr      = flag.String("backend_addr", "127.0.0.1:3128", "Cache backend address")
-	mcastAddrs       = flag.String("mcast_addrs", "", "Comma separated list of multicast addresses")
-	mcastBufSize     = flag.Int("mcast_bufsize", 16777216, "Multicast reader kernel buffer size")
-	metricsAddr      = flag.String("prometheus_addr", ":2112", "TCP network address for prometheus metrics")
-	hostRegex        = flag.String("host_regex", "", "Regex filter for valid purge hostnames (default unfiltered)")
-	nBackendWorkers  = flag.Int("backend_workers", 4, "Number of backend purger goroutines")
-	nFrontendWorkers = flag.Int("frontend_workers", 1, "Number of frontend purger goroutines")
-	frontendDelay    = flag.Int("frontend_delay", 1000, "Delay in milliseconds between backend and frontend PURGE")
-	nethttp          = flag.Bool("nethttp", false, "Use net/http (default false)")
-	kafkaTopics      = flag.String("topics", "", "Optional, comma-separated list of kafka topics to listen to.")
-	kafkaConfigFile  = flag.String("kafkaConfig", "/etc/purgedkafka.conf", "Kafka configuration file")
-	purgeMaxAge      = flag.Int("purgeMaxAge", 0, "The maximum age of a purge to send to the caches.")
-	kafkaProducer    *KafkaReader
-	purgeRequests    = promauto.NewCounterVec(prometheus.CounterOpts{
+	frontendAddr         = flag.String("frontend_addr", "127.0.0.1:80", "Cache frontend TCP address or unix:/path/to/socket")
+	backendAddr          = flag.String("backend_addr", "127.0.0.1:3128", "Cache backend TCP address or unix:/path/to/socket")
+	mcastAddrs           = flag.String("mcast_addrs", "", "Comma separated list of multicast addresses")
+	mcastBufSize         = flag.Int("mcast_bufsize", 16777216, "Multicast reader kernel buffer size")
+	metricsAddr          = flag.String("prometheus_addr", ":2112", "TCP network address for prometheus metrics")
+	hostRegex            = atomicStringFlag("host_regex", "", "Regex filter for valid purge hostnames (default unfiltered)")
+	nBackendWorkers      = atomicIntFlag("backend_workers", 4, "Number of backend purger goroutines")
+	nFrontendWorkers     = atomicIntFlag("frontend_workers", 1, "Number of frontend purger goroutines")
+	autoscaleWorkers     = flag.Bool("autoscale_workers", false, "Grow and shrink the number of workers of each layer between -backend_workers/-frontend_workers and -backend_workers_max/-frontend_workers_max, based on the backlog and PURGE latency")
+	nBackendWorkersMax   = atomicIntFlag("backend_workers_max", 32, "Maximum number of backend purger goroutines with -autoscale_workers")
+	nFrontendWorkersMax  = atomicIntFlag("frontend_workers_max", 8, "Maximum number of frontend purger goroutines with -autoscale_workers")
+	autoscaleBacklog     = atomicIntFlag("autoscale_backlog", 100, "Number of queued purges per worker above which -autoscale_workers adds workers")
+	autoscaleLatency     = atomicIntFlag("autoscale_latency", 500, "Average PURGE latency in milliseconds above which -autoscale_workers removes workers, to avoid overloading the cache")
+	frontendDelay        = atomicIntFlag("frontend_delay", 1000, "Delay in milliseconds between backend and frontend PURGE")
+	nethttp              = flag.Bool("nethttp", false, "Use net/http (default false)")
+	nethttpMaxIdle       = flag.Int("nethttp_max_idle_conns", 1, "Maximum number of idle connections to the cache kept open by each -nethttp worker")
+	nethttpIdleTimeout   = flag.Int("nethttp_idle_timeout", 90, "Time in seconds after which idle -nethttp connections to the caches are closed (0 for never)")
+	nethttpTimeout       = flag.Int("nethttp_timeout", 0, "Timeout in seconds of -nethttp requests to the caches (0 for none)")
+	nethttpTLS           = flag.Bool("nethttp_tls", false, "Connect to the caches over HTTPS with -nethttp")
+	nethttpCAFile        = flag.String("nethttp_ca_file", "", "PEM file with the CA certificates to verify the caches with -nethttp_tls (default system CAs)")
+	nethttpCertFile      = flag.String("nethttp_cert_file", "", "PEM client certificate to present to the caches with -nethttp_tls")
+	nethttpKeyFile       = flag.String("nethttp_key_file", "", "PEM private key of -nethttp_cert_file")
+	nethttpServerName    = flag.String("nethttp_server_name", "", "Name to verify the certificates of the caches against with -nethttp_tls (default the host of -backend_addr and -frontend_addr)")
+	nethttpHTTP2         = flag.Bool("nethttp_http2", false, "Speak HTTP/2 to the caches with -nethttp, multiplexing the purges of all workers of a layer on one connection: negotiated via ALPN with -nethttp_tls, h2c otherwise")
+	kafkaTopics          = flag.String("topics", "", "Optional, comma-separated list of kafka topics to listen to.")
+	kafkaConfigFile      = flag.String("kafkaConfig", "/etc/purgedkafka.conf", "Kafka configuration file")
+	kafkaCommitProcessed = flag.Bool("kafka_commit_processed", false, "Only commit the offsets of Kafka messages once their purges have been sent, discarded or spooled, rather than once read")
+	purgeMaxAge          = flag.Int("purgeMaxAge", 0, "The maximum age of a purge to send to the caches.")
+	retryAttempts        = atomicIntFlag("retry_attempts", 0, "Number of times a purge failing with an error or 5xx response is retried (0 for never)")
+	retryBackoff         = atomicIntFlag("retry_backoff", 1000, "Delay in milliseconds before retrying a failed purge, doubled on each further attempt")
+	retryMaxBackoff      = atomicIntFlag("retry_max_backoff", 60000, "Maximum delay in milliseconds before retrying a failed purge")
+	backendFailure       = atomicStringFlag("frontend_on_backend_failure", purgeFrontend, "What to do with the frontend once a purge failed on the backend -retry_attempts times: purge or skip")
+	multicastMaxAge      = atomicIntFlag("multicast_max_age", 0, "Time in seconds after which multicast purges not yet sent to the caches are discarded (0 for never)")
+	spoolDir             = flag.String("spool_dir", "", "Directory for the on-disk purge spool, with a subdirectory for each priority class (default no spool)")
+	spoolMaxBytes        = flag.Int64("spool_max_bytes", 1<<30, "Maximum size of the on-disk spool of each priority class in bytes")
+	spoolSegBytes        = flag.Int64("spool_segment_bytes", 64<<20, "Size of each on-disk spool segment in bytes, at most -spool_max_bytes")
+	spoolOverflow        = flag.String("spool_overflow", spoolDropNewest, "What to do when the spool or the spill directory is full: block, drop-newest or drop-oldest")
+	spillDir             = flag.String("spill_dir", "", "Directory where purges are spilled by the spill -overflow_policy, with a subdirectory for each priority class (default none)")
+	priorities           = flag.String("priorities", "normal:1", "Comma separated list of priority classes with their weights (eg: urgent:10,normal:5,bulk:1)")
+	priorityRules        = flag.String("priority_rules", "", "Comma separated list of rules assigning purges to priority classes, in the form field=value:class with field one of source, topic, tag or host (eg: tag=transcludes:bulk,host=^upload\\.:urgent)")
+	defaultPriority      = flag.String("default_priority", "normal", "Priority class of purges matching no -priority_rules")
+	backendType          = flag.String("backend_type", atsValue, "Cache backend type for bans: ats or varnish")
+	frontendType         = flag.String("frontend_type", varnishValue, "Cache frontend type for bans: ats or varnish")
+	banHosts             = flag.String("ban_hosts", "", "Regex of the hostnames for which bans are allowed (default bans disabled)")
+	banMinPrefix         = flag.Int("ban_min_prefix", 10, "Minimum length of the literal path prefix of ban patterns")
+	atsRevalidate        = flag.String("ats_revalidate_config", "", "ATS regex_revalidate plugin configuration file to write bans to")
+	xkeyHeader           = flag.String("xkey_header", "xkey-purge", "Request header carrying the surrogate keys to purge")
+	atsRevalidateTTL     = flag.Int("ats_revalidate_ttl", 86400, "Time in seconds after which ATS regex_revalidate rules expire")
+	adminAddr            = flag.String("admin_addr", "", "TCP network address or unix:/path/to/socket for the admin API (default served on -prometheus_addr)")
+	adminToken           = flag.String("admin_token", "", "Bearer token required to access the admin API (default no authentication, read-only unless served on a unix socket)")
+	adminSocketMode      = flag.String("admin_socket_mode", "0600", "Permissions of the admin API unix socket")
+	httpAddr             = flag.String("http_addr", "", "TCP network address to accept purges over HTTP on (default disabled)")
+	httpRate             = atomicFloatFlag("http_rate", 10, "Maximum number of URLs per second purged over HTTP by each client (0 for unlimited)")
+	httpBurst            = atomicIntFlag("http_burst", 20, "Maximum burst of URLs purged over HTTP by each client, requests with more URLs are always rate limited")
+	httpSchemeHeader     = flag.String("http_scheme_header", "", "Header carrying the scheme of the URLs purged with PURGE requests over HTTP, only to be set if -http_addr is reached through a trusted proxy (eg: X-Forwarded-Proto, default http)")
+	healthMaxBacklog     = flag.Int("health_max_backlog", 100000, "Backlog size above which purged is reported not ready (0 for unlimited)")
+	healthWorkerTime     = flag.Int("health_worker_timeout", 60, "Time in seconds after which a worker sending a purge is considered stuck")
+	normalizeURLs        = flag.Bool("normalize_urls", false, "Canonicalize percent-encoding, default ports and empty queries of purged URLs")
+	backendHostMap       = atomicStringFlag("backend_host_map", "", "Comma separated list of regex=hosts pairs: purges for a host matching regex are sent to the backend with each of the |-separated Host headers in hosts (eg: ^upload\\.wikimedia\\.org$=upload.wikimedia.org|upload-lb.wikimedia.org)")
+	frontendHostMap      = atomicStringFlag("frontend_host_map", "", "Like -backend_host_map, for the frontend")
+	backendMethod        = flag.String("backend_purge_method", "PURGE", "HTTP method of the exact purges sent to the backend (eg: REFRESH)")
+	frontendMethod       = flag.String("frontend_purge_method", "PURGE", "HTTP method of the exact purges sent to the frontend")
+	backendHeaders       = flag.String("backend_purge_headers", "", "Comma separated list of Name:value headers sent along with all requests to the backend, values cannot contain commas (eg: X-Purge-Token:secret)")
+	frontendHeaders      = flag.String("frontend_purge_headers", "", "Like -backend_purge_headers, for the frontend")
+	backendSchemeHeader  = flag.String("backend_scheme_header", "", "Header carrying the scheme of the purged URL, sent along with exact purges to the backend (eg: X-Forwarded-Proto, default none)")
+	frontendSchemeHeader = flag.String("frontend_scheme_header", "", "Like -backend_scheme_header, for the frontend")
+	purgeAllSchemes      = flag.Bool("purge_all_schemes", false, "Send exact purges once for http and once for https, rather than only for the scheme of the purged URL (requires -backend_scheme_header or -frontend_scheme_header)")
+	hostVariants         = flag.String("host_variants", "", "Comma separated list of regex=template pairs: purges for a host matching regex are also sent to the host given by template, with -normalize_urls (eg: ^([a-z]+)\\.wikipedia\\.org$=$1.m.wikipedia.org)")
+	rulesFile            = atomicStringFlag("rules_file", "", "File with the ordered list of rules applied to incoming purges, one per line")
+	checkURL             = flag.String("check_url", "", "Show which rules the given URL matches and exit (dry run)")
+	checkSource          = flag.String("check_source", kafkaValue, "Source of the URL given with -check_url")
+	configFile           = flag.String("config", "", "YAML configuration file setting any of the other flags, reloaded on SIGHUP and when modified")
+	shutdownTimeout      = flag.Int("shutdown_timeout", 10, "Time in seconds to wait on shutdown for queued purges to be sent")
+	logFormat            = flag.String("log_format", logfmtFormat, "Format of log messages: logfmt or json")
+	logLevels            = atomicStringFlag("log_level", "info", "Minimum level of log messages (debug, info, warn or error), optionally per component (eg: info,kafka:debug,multicast:error)")
+	logRate              = atomicFloatFlag("log_rate", 10, "Maximum number of messages per second logged by each hot path error, such as invalid packets (0 for unlimited)")
+	auditDest            = flag.String("audit_log", "", "File or unix:/path/to/socket to write the audit log of purges to (default disabled)")
+	auditMaxBytes        = flag.Int64("audit_log_max_bytes", 100<<20, "Size in bytes at which the audit log file is rotated (0 for never)")
+	auditBackups         = flag.Int("audit_log_backups", 5, "Number of rotated audit log files to keep")
+	auditSampleRate      = atomicFloatFlag("audit_sample_rate", 1, "Fraction of purges recorded in the audit log, between 0 and 1")
+	auditHost            = atomicStringFlag("audit_host", "", "Only record the purges with a hostname matching this regex in the audit log")
+	auditPath            = atomicStringFlag("audit_path", "", "Only record the purges with a path starting with this prefix in the audit log")
+	otelEndpoint         = flag.String("otel_endpoint", "", "OTLP/HTTP traces endpoint to export the trace spans of purges to (eg: http://127.0.0.1:4318/v1/traces, default tracing disabled)")
+	otelService          = flag.String("otel_service_name", "purged", "Service name of the exported trace spans")
+	otelSampleRate       = atomicFloatFlag("otel_sample_rate", 0.01, "Fraction of purges traced, between 0 and 1")
+	overflowPolicy       = flag.String("overflow_policy", overflowBlock, "What to do when the backend queue is full: block, drop-newest, drop-oldest or spill, optionally per source (eg: multicast:drop-oldest,kafka:block). Only block applies with -spool_dir, see -spool_overflow")
+	kafkaProducer        *KafkaReader
+	purgeRequests        = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "purged_http_requests_total",
 		Help: "Total number of HTTP PURGE sent by status code",
 	}, []string{
@@ -100,36 +224,70 @@ var (
 		Help: "Number of messages still to be processed by backend and frontend workers",
 	}, []string{
 		layerLabel,
+		priorityLabel,
 	})
+
+	mainLog   = NewLogger("main")
+	workerLog = NewLogger("worker")
+	// Hot path errors, when the caches are unreachable or on bad input
+	connErrorLog  = workerLog.Limited()
+	sendErrorLog  = workerLog.Limited()
+	parseErrorLog = workerLog.Limited()
 )
 
+// splitAddr returns the network and address to dial for addr, which is
+// either a TCP address or a unix socket path prefixed by unix:.
+func splitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return "tcp", addr
+}
+
 func connOrFatal(addr string) net.Conn {
+	network, address := splitAddr(addr)
 	for i := 7; i < connectionAttempts; i++ {
-		conn, err := net.Dial("tcp", addr)
+		conn, err := net.Dial(network, address)
 		if err == nil {
 			return conn
 		} else {
 			connectRetryTime := math.Pow(2, float64(i))
-			log.Printf("Error connecting to %v: %v. Reconnecting in %v milliseconds\n", addr, err, connectRetryTime)
+			connErrorLog.Warn("Error connecting, reconnecting", "addr", addr, "err", err, "retry_ms", connectRetryTime)
 			time.Sleep(time.Duration(connectRetryTime) * time.Millisecond)
 		}
 	}
 
-	log.Fatal("Giving up connecting to ", addr)
+	workerLog.Fatal("Giving up connecting", "addr", addr)
 	return nil
 }
 
 func NewTCPPurger(addr string) *TCPPurger {
-	return &TCPPurger{conn: connOrFatal(addr), destAddr: addr}
+	return &TCPPurger{conn: connOrFatal(addr), destAddr: addr, xkeyHeader: *xkeyHeader, template: defaultTemplate}
 }
 
 func (p *TCPPurger) Send(host, uri string) (string, error) {
+	return p.SendRequest(PurgeRequest{Host: host, URI: uri})
+}
+
+func (p *TCPPurger) SendRequest(r PurgeRequest) (string, error) {
+	return p.send(p.template.raw(r), fmt.Sprintf("%s (Host: %s)", r.URI, r.Host))
+}
+
+// Ban sends a Varnish BAN request. The ban expression is passed in a header,
+// to be used by VCL in vcl_recv.
+func (p *TCPPurger) Ban(host, pattern string) (string, error) {
+	return p.send(fmt.Sprintf(banReq, host, banExpression(host, pattern), p.template.rawHeaders()), fmt.Sprintf("ban %s (Host: %s)", pattern, host))
+}
+
+// send writes the raw HTTP request req, reconnecting and trying again on
+// failure. desc is used for error reporting.
+func (p *TCPPurger) send(req, desc string) (string, error) {
 	buffer := make([]byte, 4096)
 
 	var errType string
 
 	for i := 0; i < sendAttempts; i++ {
-		_, err := fmt.Fprintf(p.conn, purgeReq, uri, host)
+		_, err := io.WriteString(p.conn, req)
 		if err != nil {
 			// OpErrors are common (eg: broken pipe), we don't need to log
 			// them. Incrementing the relevant metric is enough.
@@ -137,7 +295,7 @@ func (p *TCPPurger) Send(host, uri string) (string, error) {
 				errType = opErr.Err.Error()
 			} else {
 				errType = "write"
-				log.Printf("Write error: %v\n", err)
+				connErrorLog.Warn("Write error", "addr", p.destAddr, "err", err)
 			}
 
 			tcpErrors.With(prometheus.Labels{typeLabel: errType}).Inc()
@@ -153,7 +311,7 @@ func (p *TCPPurger) Send(host, uri string) (string, error) {
 				errType = "EOF"
 			} else {
 				errType = "read"
-				log.Printf("Read error: %v\n", err)
+				connErrorLog.Warn("Read error", "addr", p.destAddr, "err", err)
 			}
 			tcpErrors.With(prometheus.Labels{typeLabel: errType}).Inc()
 			p.conn = connOrFatal(p.destAddr)
@@ -165,25 +323,59 @@ func (p *TCPPurger) Send(host, uri string) (string, error) {
 		}
 	}
 
-	return "", errors.New(fmt.Sprintf("Failed purging %s (Host: %s) after %d attempts", uri, host, sendAttempts))
+	return "", errors.New(fmt.Sprintf("Failed purging %s after %d attempts", desc, sendAttempts))
+}
+
+// Close closes the connection to the cache.
+func (p *TCPPurger) Close() error {
+	return p.conn.Close()
+}
+
+func NewHTTPPurger(addr string, opts HTTPPurgerOptions) *HTTPPurger {
+	// Override DefaultTransport: unless speaking HTTP/2, each HTTPPurger has
+	// its own connections to addr
+	client := http.Client{Transport: opts.transport(addr), Timeout: opts.Timeout}
+	return &HTTPPurger{client: client, baseURL: opts.baseURL(addr), destAddr: addr, xkeyHeader: *xkeyHeader, template: defaultTemplate, shared: opts.HTTP2}
 }
 
-func NewHTTPPurger(addr string) *HTTPPurger {
-	// Override DefaultTransport and keep it simple: establish one TCP
-	// connection to addr for each HTTPPurger
-	var netTransport = &http.Transport{}
-	client := http.Client{Transport: netTransport}
-	return &HTTPPurger{client: client, destAddr: addr}
+func (p *HTTPPurger) newRequest(method, host, uri string) (*http.Request, error) {
+	req, err := http.NewRequest(method, p.baseURL+uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	return req, nil
 }
 
 func (p *HTTPPurger) Send(host, uri string) (string, error) {
+	return p.SendRequest(PurgeRequest{Host: host, URI: uri})
+}
+
+func (p *HTTPPurger) SendRequest(r PurgeRequest) (string, error) {
 	// Create request
-	req, err := http.NewRequest("PURGE", "http://"+p.destAddr+uri, nil)
+	req, err := p.newRequest(p.template.Method, r.Host, r.URI)
 	if err != nil {
 		return "", err
 	}
-	req.Host = host
+	p.template.setHeaders(req, r)
+
+	return p.do(req)
+}
 
+// Ban sends a Varnish BAN request. The ban expression is passed in a header,
+// to be used by VCL in vcl_recv.
+func (p *HTTPPurger) Ban(host, pattern string) (string, error) {
+	req, err := p.newRequest("BAN", host, "/")
+	if err != nil {
+		return "", err
+	}
+	p.template.setExtraHeaders(req)
+	req.Header.Set(banHeader, banExpression(host, pattern))
+
+	return p.do(req)
+}
+
+func (p *HTTPPurger) do(req *http.Request) (string, error) {
 	// Send request
 	resp, err := p.client.Do(req)
 	if err != nil {
@@ -203,150 +395,827 @@ func (p *HTTPPurger) Send(host, uri string) (string, error) {
 	return status, err
 }
 
-// delayedPurge sends the given url on the given channel. The reason for
+// Close closes the idle connections to the cache, unless shared with other
+// HTTPPurgers.
+func (p *HTTPPurger) Close() error {
+	if !p.shared {
+		p.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// newPurgeClient returns the PurgeClient for a cache layer of the given type
+// listening on addr, sending requests according to template.
+func newPurgeClient(addr, cacheType string, template *RequestTemplate) PurgeClient {
+	var client PurgeClient
+
+	if *nethttp {
+		purger := NewHTTPPurger(addr, httpPurgerOptions)
+		purger.template = template
+		client = purger
+	} else {
+		purger := NewTCPPurger(addr)
+		purger.template = template
+		client = purger
+	}
+
+	if cacheType == atsValue {
+		client = NewATSRevalidator(client, *atsRevalidate, time.Duration(*atsRevalidateTTL)*time.Second)
+	}
+
+	return client
+}
+
+// sendPurge sends p to the given layer, updating the relevant metrics and
+// the audit record of p. The purge is sent once for each Host header given by
+// the layer HostMap, and for each scheme given by purgeSchemes.
+func sendPurge(client PurgeClient, layer string, p Purge, parsedURL *url.URL) error {
+	var firstErr error
+	var statuses []string
+	for _, host := range hostMaps[layer].Hosts(parsedURL.Host) {
+		for _, scheme := range purgeSchemes(p, layer, parsedURL) {
+			spanID := p.Trace.newSpanID()
+			start := time.Now()
+			status, err := sendPurgeHost(client, layer, p, host, scheme, parsedURL, p.Trace.traceparent(spanID))
+			layerLatency[layer].observe(time.Since(start))
+			err = checkStatus(host, status, err)
+			tracer.Stage(p, spanID, layer+" "+purgeMethod(p), clientSpan, start, time.Now(), err,
+				"purged.layer", layer, "purged.host", host, "url.scheme", scheme, "http.response.status_code", status)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			statuses = append(statuses, status)
+		}
+	}
+
+	now := time.Now()
+	if firstErr == nil {
+		observeAck(layer, p, now)
+	}
+	p.Audit.sent(layer, strings.Join(statuses, ","), firstErr, now)
+	return firstErr
+}
+
+// purgeSchemes returns the schemes to send p to layer with: both http and
+// https for exact purges with -purge_all_schemes, so that caches keying
+// objects on the scheme given by the scheme header of the layer drop both
+// variants, or the scheme of the purged URL otherwise. Layers without a
+// scheme header would get the very same request twice.
+func purgeSchemes(p Purge, layer string, parsedURL *url.URL) []string {
+	if p.Kind == "" && *purgeAllSchemes && requestTemplates[layer].SchemeHeader != "" {
+		return allSchemes
+	}
+	return []string{parsedURL.Scheme}
+}
+
+// purgeMethod returns the kind of request sent for p.
+func purgeMethod(p Purge) string {
+	if p.Kind == "" {
+		return "purge"
+	}
+	return p.Kind
+}
+
+// sendPurgeHost sends p to the given layer with the given Host header. The
+// scheme and traceparent header, if not empty, are sent along with exact
+// purges.
+func sendPurgeHost(client PurgeClient, layer string, p Purge, host, scheme string, parsedURL *url.URL, traceparent string) (string, error) {
+	switch p.Kind {
+	case banKind:
+		status, err := client.Ban(host, p.Pattern)
+		if err != nil {
+			sendErrorLog.Error("Error banning", "layer", layer, "host", host, "err", err)
+		}
+		bans.With(prometheus.Labels{statusLabel: status, layerLabel: layer}).Inc()
+		return status, err
+	case xkeyKind:
+		status, err := client.PurgeKeys(host, p.Keys)
+		if err != nil {
+			sendErrorLog.Error("Error purging keys", "layer", layer, "host", host, "err", err)
+		}
+		xkeyPurges.With(prometheus.Labels{statusLabel: status, layerLabel: layer}).Inc()
+		return status, err
+	}
+
+	var status string
+	var err error
+	if rc, ok := client.(RequestPurgeClient); ok {
+		status, err = rc.SendRequest(PurgeRequest{Host: host, URI: parsedURL.RequestURI(), Scheme: scheme, Traceparent: traceparent})
+	} else {
+		status, err = client.Send(host, parsedURL.RequestURI())
+	}
+	if err != nil {
+		sendErrorLog.Error("Error purging", "layer", layer, "host", host, "err", err)
+	}
+	// Update purged_http_requests_total
+	purgeRequests.With(prometheus.Labels{statusLabel: status, layerLabel: layer}).Inc()
+	return status, err
+}
+
+// HostFilter holds the regex purge hostnames must match, which can be
+// changed at runtime. A nil HostFilter or regex lets all hostnames through.
+type HostFilter struct {
+	re atomic.Value
+}
+
+func NewHostFilter(re *regexp.Regexp) *HostFilter {
+	f := &HostFilter{}
+	f.Set(re)
+	return f
+}
+
+func (f *HostFilter) Set(re *regexp.Regexp) {
+	f.re.Store(re)
+}
+
+func (f *HostFilter) Get() *regexp.Regexp {
+	if f == nil {
+		return nil
+	}
+	return f.re.Load().(*regexp.Regexp)
+}
+
+func (f *HostFilter) Match(host string) bool {
+	re := f.Get()
+	return re == nil || re.MatchString(host)
+}
+
+// finishPurge records the outcome of p, once sent to all layers or discarded,
+// in the audit log and in its trace.
+func finishPurge(p Purge, result string) {
+	if p.Audit != nil {
+		p.Audit.log.Finish(p, result)
+	}
+	tracer.Finish(p, result)
+	p.offsets.Done(p)
+}
+
+// expired returns true if p is older than the maximum age of its source: the
+// age of Kafka purges is computed from the time of their event, that of
+// multicast purges from the time they were received.
+func expired(p Purge, now time.Time) bool {
+	var maxAge time.Duration
+	var since time.Time
+	switch p.Source {
+	case kafkaValue:
+		maxAge, since = time.Duration(*purgeMaxAge)*time.Second, p.EventTime
+	case multicastValue:
+		maxAge, since = time.Duration(multicastMaxAge.Load())*time.Second, p.Received
+	}
+
+	return maxAge > 0 && !since.IsZero() && now.Sub(since) > maxAge
+}
+
+// discardExpired finishes p and returns true if it is too old to be sent to
+// the given layer.
+func discardExpired(p Purge, layer string) bool {
+	if !expired(p, time.Now()) {
+		return false
+	}
+
+	purgeRequests.With(prometheus.Labels{statusLabel: expiredResult, layerLabel: layer}).Inc()
+	finishPurge(p, expiredResult)
+	return true
+}
+
+// Number of purges waiting for -frontend_delay or their retry backoff to
+// expire
+var delayedPurges int64
+
+// delayedPurge sends the given purge on the given channel. The reason for
 // returning a function here is that we want to use time.AfterFunc, which takes
 // a function as an argument -- just func(), without parameters.
-func delayedPurge(chout chan url.URL, toPurge url.URL) func() {
+func delayedPurge(chout chan Purge, toPurge Purge) func() {
+	atomic.AddInt64(&delayedPurges, 1)
 	return func() {
+		toPurge.queued = time.Now()
 		chout <- toPurge
+		atomic.AddInt64(&delayedPurges, -1)
 	}
 }
 
-func backendWorker(addr string, chin chan string, chout chan url.URL, re *regexp.Regexp) {
-	var backend PurgeClient
-
-	if *nethttp {
-		backend = NewHTTPPurger(addr)
-	} else {
-		backend = NewTCPPurger(addr)
+// receive returns the next purge on chin, or false once quit is closed.
+func receive(chin chan Purge, quit chan struct{}) (Purge, bool) {
+	select {
+	case p, ok := <-chin:
+		return p, ok
+	case <-quit:
+		return Purge{}, false
 	}
+}
 
-	for rawURL := range chin {
-		parsedURL, err := url.Parse(rawURL)
+func backendWorker(addr string, chin chan Purge, chout chan Purge, filter *HostFilter, quit chan struct{}) {
+	status := registerWorker(backendValue, addr)
+	status.setState(connectingState)
+	backend := newPurgeClient(addr, *backendType, requestTemplates[backendValue])
+	defer backend.Close()
+	status.setClient(backend)
+	defer status.unregister()
+
+	for {
+		p, ok := receive(chin, quit)
+		if !ok {
+			return
+		}
+		tracer.Stage(p, "", backendValue+" queue", internalSpan, p.queued, time.Now(), nil)
+
+		parsedURL, err := url.Parse(p.URL)
 		if err != nil {
-			log.Println("Error parsing", rawURL, err)
+			parseErrorLog.Warn("Error parsing URL", "source", p.Source, "topic", p.Topic, "partition", p.Partition, "offset", p.Offset, "url", p.URL, "err", err)
+			finishPurge(p, invalidResult)
+			continue
+		}
+
+		if !filter.Match(parsedURL.Host) {
+			finishPurge(p, filteredResult)
+			continue
+		}
+
+		if p.Layer == frontendValue {
+			// Skip the backend, the frontend delay still applies
+			time.AfterFunc(time.Duration(frontendDelay.Load())*time.Millisecond, delayedPurge(chout, p))
 			continue
 		}
 
-		if re != nil && !re.Match([]byte(parsedURL.Host)) {
+		if discardExpired(p, backendValue) {
 			continue
 		}
 
-		status, err := backend.Send(parsedURL.Host, parsedURL.RequestURI())
+		status.setState(sendingState)
+		err = sendPurge(backend, backendValue, p, parsedURL)
+		status.done(err)
+
 		if err != nil {
-			log.Printf("Error purging backend: %s", err)
+			if retryPurge(chin, p, backendValue) {
+				continue
+			}
+			giveUp(p, backendValue, err)
+			if backendFailure.Load() == skipFrontend {
+				finishPurge(p, failedResult)
+				continue
+			}
 		}
-		// Update purged_http_requests_total
-		purgeRequests.With(prometheus.Labels{statusLabel: status, layerLabel: backendValue}).Inc()
+		p.attempts = 0
 
-		// Send parsed URL to frontend workers
-		time.AfterFunc(time.Duration(*frontendDelay)*time.Millisecond, delayedPurge(chout, *parsedURL))
+		// Send purge to frontend workers
+		if p.Layer != backendValue {
+			time.AfterFunc(time.Duration(frontendDelay.Load())*time.Millisecond, delayedPurge(chout, p))
+		} else {
+			finishPurge(p, sentResult)
+		}
 	}
 }
 
-func frontendWorker(addr string, chin chan url.URL) {
-	var frontend PurgeClient
+func frontendWorker(addr string, chin chan Purge, quit chan struct{}) {
+	status := registerWorker(frontendValue, addr)
+	status.setState(connectingState)
+	frontend := newPurgeClient(addr, *frontendType, requestTemplates[frontendValue])
+	defer frontend.Close()
+	status.setClient(frontend)
+	defer status.unregister()
 
-	if *nethttp {
-		frontend = NewHTTPPurger(addr)
-	} else {
-		frontend = NewTCPPurger(addr)
-	}
+	for {
+		p, ok := receive(chin, quit)
+		if !ok {
+			return
+		}
 
-	for parsedURL := range chin {
-		status, err := frontend.Send(parsedURL.Host, parsedURL.RequestURI())
-		if err != nil {
-			log.Printf("Error purging frontend: %s", err)
+		now := time.Now()
+		observeQueued(frontendValue, "", p, now)
+		tracer.Stage(p, "", frontendValue+" delay", internalSpan, time.Time{}, p.queued, nil)
+		tracer.Stage(p, "", frontendValue+" queue", internalSpan, p.queued, now, nil)
+
+		if discardExpired(p, frontendValue) {
+			continue
+		}
+
+		// Already validated by backendWorker
+		parsedURL, _ := url.Parse(p.URL)
+		status.setState(sendingState)
+		err := sendPurge(frontend, frontendValue, p, parsedURL)
+		status.done(err)
+
+		if err != nil && retryPurge(chin, p, frontendValue) {
+			continue
 		}
-		// Update purged_http_requests_total
-		purgeRequests.With(prometheus.Labels{statusLabel: status, layerLabel: frontendValue}).Inc()
+		finishPurge(p, sentResult)
 	}
 }
 
-func startWorkers(beAddr, feAddr string, chBackend chan string, chFrontend chan url.URL, re *regexp.Regexp) {
-	for i := 0; i < *nBackendWorkers; i++ {
-		go backendWorker(beAddr, chBackend, chFrontend, re)
+// WorkerPool runs a variable number of workers.
+type WorkerPool struct {
+	mutex sync.Mutex
+	start func(quit chan struct{})
+	quits []chan struct{}
+}
+
+// NewWorkerPool returns a pool of n workers. Each worker is started by
+// calling start in a goroutine, and must return once quit is closed.
+func NewWorkerPool(n int, start func(quit chan struct{})) *WorkerPool {
+	p := &WorkerPool{start: start}
+	p.Resize(n)
+	return p
+}
+
+// Resize starts or stops workers so that n of them are running. Stopped
+// workers finish sending their current purge first.
+func (p *WorkerPool) Resize(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for len(p.quits) < n {
+		quit := make(chan struct{})
+		p.quits = append(p.quits, quit)
+		go p.start(quit)
 	}
 
-	for i := 0; i < *nFrontendWorkers; i++ {
-		go frontendWorker(feAddr, chFrontend)
+	for len(p.quits) > n {
+		close(p.quits[len(p.quits)-1])
+		p.quits = p.quits[:len(p.quits)-1]
 	}
 }
 
+// Size returns the number of workers running.
+func (p *WorkerPool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.quits)
+}
+
+func startWorkers(beAddr, feAddr string, chBackend chan Purge, chFrontend chan Purge, filter *HostFilter) (*WorkerPool, *WorkerPool) {
+	backends := NewWorkerPool(nBackendWorkers.Load(), func(quit chan struct{}) {
+		backendWorker(beAddr, chBackend, chFrontend, filter, quit)
+	})
+
+	frontends := NewWorkerPool(nFrontendWorkers.Load(), func(quit chan struct{}) {
+		frontendWorker(feAddr, chFrontend, quit)
+	})
+
+	return backends, frontends
+}
+
 func main() {
 	flag.Parse()
 
+	var config *Config
+	if *configFile != "" {
+		config = NewConfig(*configFile, cmdlineFlags())
+		if err := config.Load(); err != nil {
+			mainLog.Fatal("Error loading configuration", "file", *configFile, "err", err)
+		}
+	}
+
+	if *logFormat != logfmtFormat && *logFormat != jsonFormat {
+		mainLog.Fatal("Invalid -log_format", "log_format", *logFormat)
+	}
+	if err := checkBackendFailure(backendFailure.Load()); err != nil {
+		mainLog.Fatal("Invalid -frontend_on_backend_failure", "err", err)
+	}
+	if err := setLogLevels(logLevels.Load()); err != nil {
+		mainLog.Fatal("Invalid -log_level", "err", err)
+	}
+	// Log the messages of libraries like everything else
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{mainLog})
+
 	// Serve prometheus metrics under /metrics, profiling under /debug/pprof
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
 		http.ListenAndServe(*metricsAddr, nil)
 	}()
 
-	if *mcastAddrs == "" && *kafkaTopics == "" {
-		log.Fatalf("At least one of -mcast_addrs or -topics must be specified")
+	var rules RuleSet
+	if rulesFile.Load() != "" {
+		var err error
+		if rules, err = LoadRules(rulesFile.Load()); err != nil {
+			mainLog.Fatal("Error loading rules", "file", rulesFile.Load(), "err", err)
+		}
+	}
+
+	var normalizer *Normalizer
+	if *normalizeURLs {
+		var err error
+		if normalizer, err = NewNormalizer(*hostVariants); err != nil {
+			mainLog.Fatal("Invalid -host_variants", "err", err)
+		}
+	}
+
+	if *checkURL != "" {
+		for _, p := range normalizer.Normalize(Purge{URL: *checkURL, Source: *checkSource}) {
+			d := rules.Evaluate(p)
+			fmt.Printf("%s\n", p.URL)
+			fmt.Printf("  matched rules: %s\n", strings.Join(d.Matched, " "))
+			fmt.Printf("  allowed: %t\n", d.Allowed)
+			if d.Allowed {
+				fmt.Printf("  url: %s\n", d.Purge.URL)
+				if d.Purge.Layer != "" {
+					fmt.Printf("  layer: %s\n", d.Purge.Layer)
+				}
+			}
+		}
+		os.Exit(0)
+	}
+	ruleEngine := NewRuleEngine(rules)
+
+	if *otelEndpoint != "" {
+		tracer = NewTracer(*otelEndpoint, *otelService)
+		go tracer.Run()
+	}
+
+	var auditLog *AuditLog
+	if *auditDest != "" {
+		var err error
+		if auditLog, err = NewAuditLog(*auditDest, *auditMaxBytes, *auditBackups); err != nil {
+			mainLog.Fatal("Error opening the audit log", "audit_log", *auditDest, "err", err)
+		}
+		if err := auditLog.SetFilter(auditHost.Load(), auditPath.Load()); err != nil {
+			mainLog.Fatal("Invalid -audit_host", "err", err)
+		}
+	}
+
+	if err := hostMaps[backendValue].Set(backendHostMap.Load()); err != nil {
+		mainLog.Fatal("Invalid -backend_host_map", "err", err)
+	}
+	if err := hostMaps[frontendValue].Set(frontendHostMap.Load()); err != nil {
+		mainLog.Fatal("Invalid -frontend_host_map", "err", err)
+	}
+
+	backendTemplate, err := NewRequestTemplate(*backendMethod, *backendHeaders, *backendSchemeHeader)
+	if err != nil {
+		mainLog.Fatal("Invalid backend request template", "err", err)
+	}
+	frontendTemplate, err := NewRequestTemplate(*frontendMethod, *frontendHeaders, *frontendSchemeHeader)
+	if err != nil {
+		mainLog.Fatal("Invalid frontend request template", "err", err)
+	}
+	requestTemplates[backendValue], requestTemplates[frontendValue] = backendTemplate, frontendTemplate
+	for _, tmpl := range requestTemplates {
+		for _, h := range tmpl.Headers {
+			if http.CanonicalHeaderKey(h.name) == http.CanonicalHeaderKey(*xkeyHeader) {
+				mainLog.Fatal("Purge headers cannot set the -xkey_header", "header", h.name)
+			}
+		}
+	}
+
+	if *purgeAllSchemes && backendTemplate.SchemeHeader == "" && frontendTemplate.SchemeHeader == "" {
+		mainLog.Fatal("-purge_all_schemes requires -backend_scheme_header or -frontend_scheme_header")
+	}
+
+	if *mcastAddrs == "" && *kafkaTopics == "" && *httpAddr == "" {
+		mainLog.Fatal("At least one of -mcast_addrs, -topics or -http_addr must be specified")
+	}
+
+	// Without a spool, the priority queue holds the whole backlog. With a
+	// spool, that is on disk instead: keep the in-memory queue short so
+	// that little is lost on crash
+	queueLen := bufferLen
+	if *spoolDir != "" {
+		queueLen = nBackendWorkers.Load()
+	}
+
+	queue, err := NewPriorityQueue(*priorities, *priorityRules, *defaultPriority, queueLen)
+	if err != nil {
+		mainLog.Fatal("Invalid priority configuration", "err", err)
+	}
+
+	policies, err := parseOverflowPolicies(*overflowPolicy)
+	if err != nil {
+		mainLog.Fatal("Invalid -overflow_policy", "err", err)
 	}
 
-	chBackend := make(chan string, bufferLen)
+	// Purges from the readers are queued to ingress. Without a spool, that is
+	// the priority queue
+	var ingress Queue = queue
+	var spool *PrioritySpool
+	var chIngress chan Purge
+	if *spoolDir != "" {
+		// The spool itself is the backlog, its overflow policy applies
+		for _, policy := range policies {
+			if policy != overflowBlock {
+				mainLog.Fatal("Only the block -overflow_policy applies with -spool_dir, see -spool_overflow")
+			}
+		}
+		if *spillDir != "" {
+			mainLog.Fatal("-spill_dir cannot be used with -spool_dir")
+		}
+
+		spool, err = NewPrioritySpool(*spoolDir, *spoolMaxBytes, *spoolSegBytes, *spoolOverflow, queue)
+		if err != nil {
+			mainLog.Fatal("Error opening spool", "dir", *spoolDir, "err", err)
+		}
+
+		// Unbuffered, so that purges are not held in memory ahead of the
+		// spool
+		chIngress = make(chan Purge)
+		ingress = chanQueue(chIngress)
+		spool.AuditLog = auditLog
+		go spool.Run(chIngress)
+	}
+
+	// Purges overflowing the priority queue with the spill policy are
+	// written to their own spool, replayed once there is room. Like the
+	// spool, it is persisted on shutdown.
+	var spill *PrioritySpool
+	if *spillDir != "" {
+		spill, err = NewPrioritySpool(*spillDir, *spoolMaxBytes, *spoolSegBytes, *spoolOverflow, queue)
+		if err != nil {
+			mainLog.Fatal("Error opening spill directory", "dir", *spillDir, "err", err)
+		}
+
+		spill.AuditLog = auditLog
+		spill.Replay()
+		spool = spill
+	}
+
+	// channel for consumption by backend workers
+	chBackend := make(chan Purge)
+	go queue.Run(chBackend)
+
+	// Offsets of the Kafka purges being processed, if -kafka_commit_processed
+	var offsets *OffsetTracker
+	if *kafkaTopics != "" && *kafkaCommitProcessed {
+		offsets = NewOffsetTracker()
+	}
+
+	// Bans allowed, checked when read and again once normalized
+	var banGuard *BanGuard
+	if *banHosts != "" {
+		re, err := regexp.Compile(*banHosts)
+		if err != nil {
+			mainLog.Fatal("Invalid -ban_hosts", "err", err)
+		}
+		banGuard = &BanGuard{Hosts: re, MinPrefix: *banMinPrefix}
+	}
+
+	// Each reader sends purges to its own channel, from which they are
+	// forwarded to ingress according to the source overflow policy
+	ingresses := make(map[string]*Ingress)
+	var sources []chan Purge
+	sourceChannel := func(source string) chan Purge {
+		in, err := NewIngress(source, policies, ingress, spill)
+		if err != nil {
+			mainLog.Fatal("Error creating ingress", "source", source, "err", err)
+		}
+		in.Normalizer = normalizer
+		in.Rules = ruleEngine
+		in.Offsets = offsets
+		in.AuditLog = auditLog
+		in.BanGuard = banGuard
+		ingresses[source] = in
+
+		c := make(chan Purge, sourceBufferLen)
+		sources = append(sources, c)
+		go in.Run(c)
+		return c
+	}
+
+	var re *regexp.Regexp
+	if hostRegex.Load() != "" {
+		re = regexp.MustCompile(hostRegex.Load())
+	} else {
+		re = nil
+	}
+	filter := NewHostFilter(re)
 
 	// Setup multicast reader if the user passed -mcast_addrs
 	if *mcastAddrs != "" {
-		pr := MultiCastReader{maxDatagramSize: 4096, mcastAddrs: *mcastAddrs, kbufSize: *mcastBufSize}
-		// Begin producing URLs to chBackend for consumption by backend workers
-		go pr.Read(chBackend)
+		pr := MultiCastReader{maxDatagramSize: 4096, mcastAddrs: *mcastAddrs, kbufSize: *mcastBufSize, Done: make(chan struct{})}
+		// Begin producing URLs for consumption by backend workers
+		go func(c chan Purge, status *ReaderStatus) {
+			pr.Read(c)
+			status.stopped()
+		}(sourceChannel(multicastValue), registerReader(multicastValue, func() { close(pr.Done) }))
 	}
 
 	// If we're also listening on kafka, setup the kafka reader too
 	if *kafkaTopics != "" {
 		// Given kafka has an eventloop, we need to reliably signal it that the work is done when exiting
-		sigchan := make(chan os.Signal, 1)
-		// We stop execution on signals SIGTERM and SIGINT
-		signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-		// Channel to notify the goroutines.
 		done := make(chan struct{})
-		go func() {
-			for sig := range sigchan {
-				log.Printf("Exiting on signal %v", sig)
-				// Send kafka a message telling it to stop
-				m := struct{}{}
-				done <- m
-				// Wait for kafka to communicate back by closing the channel
-				<-done
-				os.Exit(0)
-			}
-		}()
-		var err error
-		log.Printf("Listening for topics %s", *kafkaTopics)
+		kafkaLog.Info("Listening for topics", "topics", *kafkaTopics)
 		topics := strings.Split(*kafkaTopics, ",")
-		kafkaProducer, err = NewKafkaReader(*kafkaConfigFile, topics, done, *purgeMaxAge)
+		kafkaProducer, err = NewKafkaReader(*kafkaConfigFile, topics, done, *purgeMaxAge, offsets)
 		if err != nil {
-			log.Fatal(err)
+			mainLog.Fatal("Error creating kafka reader", "err", err)
 		}
-		go func(c chan string) {
+		kafkaProducer.BanGuard = banGuard
+		// Send kafka a message telling it to stop, unless it already did
+		var kafkaStatus *ReaderStatus
+		kafkaStatus = registerReader(kafkaValue, func() {
+			select {
+			case done <- struct{}{}:
+			case <-kafkaStatus.finished:
+			}
+		})
+		go func(c chan Purge, status *ReaderStatus) {
 			kafkaProducer.Read(c)
-			log.Println("Kafka connection stopped")
-		}(chBackend)
+			kafkaLog.Info("Kafka connection stopped")
+			status.stopped()
+		}(sourceChannel(kafkaValue), kafkaStatus)
+	}
+
+	// Accept purges over HTTP if the user passed -http_addr
+	if *httpAddr != "" {
+		hr := NewHTTPReader(*httpAddr, filter, httpRate.Load(), httpBurst.Load())
+		hr.SchemeHeader = *httpSchemeHeader
+		go func(c chan Purge, status *ReaderStatus) {
+			hr.Read(c)
+			status.stopped()
+		}(sourceChannel(httpValue), registerReader(httpValue, hr.Stop))
+
+		if config != nil {
+			setRate := func() error {
+				hr.SetRate(httpRate.Load(), httpBurst.Load())
+				return nil
+			}
+			config.Live("http_rate", setRate)
+			config.Live("http_burst", setRate)
+		}
 	}
 
 	// channel for consumption by frontend workers
-	chFrontend := make(chan url.URL, bufferLen)
+	chFrontend := make(chan Purge, bufferLen)
+
+	if *nethttp && *nethttpHTTP2 && *autoscaleWorkers {
+		// All workers of a layer share one connection, there is nothing to
+		// scale
+		mainLog.Fatal("-autoscale_workers cannot be used with -nethttp_http2")
+	}
+
+	httpPurgerOptions = HTTPPurgerOptions{
+		MaxIdleConns: *nethttpMaxIdle,
+		IdleTimeout:  time.Duration(*nethttpIdleTimeout) * time.Second,
+		Timeout:      time.Duration(*nethttpTimeout) * time.Second,
+		HTTP2:        *nethttpHTTP2,
+	}
+	if *nethttpTLS {
+		tlsConfig, err := loadTLSConfig(*nethttpCAFile, *nethttpCertFile, *nethttpKeyFile, *nethttpServerName)
+		if err != nil {
+			mainLog.Fatal("Error loading the TLS configuration", "err", err)
+		}
+		httpPurgerOptions.TLS = tlsConfig
+	}
 
 	// Start backend and frontend workers
-	var re *regexp.Regexp
-	if *hostRegex != "" {
-		re = regexp.MustCompile(*hostRegex)
+	backends, frontends := startWorkers(*backendAddr, *frontendAddr, chBackend, chFrontend, filter)
+	if *autoscaleWorkers {
+		// With a spool, most of the backlog waits on disk
+		go (&Autoscaler{Pool: backends, Min: nBackendWorkers, Max: nBackendWorkersMax, Latency: layerLatency[backendValue], Backlog: func() int {
+			if spool != nil {
+				return queue.Pending() + int(spool.Len())
+			}
+			return queue.Pending()
+		}}).Run()
+		go (&Autoscaler{Pool: frontends, Min: nFrontendWorkers, Max: nFrontendWorkersMax, Latency: layerLatency[frontendValue], Backlog: func() int {
+			return len(chFrontend)
+		}}).Run()
+	}
+
+	// Apply the settings which can be changed at runtime on reload
+	if config != nil {
+		config.Live("host_regex", func() error {
+			re, err := regexp.Compile(hostRegex.Load())
+			if err != nil {
+				return err
+			}
+			if hostRegex.Load() == "" {
+				re = nil
+			}
+			filter.Set(re)
+			return nil
+		})
+		config.Live("frontend_delay", nil)
+		config.Live("multicast_max_age", nil)
+		config.Live("retry_attempts", nil)
+		config.Live("retry_backoff", nil)
+		config.Live("retry_max_backoff", nil)
+		config.Live("frontend_on_backend_failure", func() error {
+			return checkBackendFailure(backendFailure.Load())
+		})
+		config.Live("log_level", func() error {
+			return setLogLevels(logLevels.Load())
+		})
+		config.Live("log_rate", nil)
+		config.Live("audit_sample_rate", nil)
+		config.Live("otel_sample_rate", nil)
+		setAuditFilter := func() error {
+			if auditLog == nil {
+				return nil
+			}
+			return auditLog.SetFilter(auditHost.Load(), auditPath.Load())
+		}
+		config.Live("audit_host", setAuditFilter)
+		config.Live("audit_path", setAuditFilter)
+		config.Live("rules_file", func() error {
+			var rules RuleSet
+			if rulesFile.Load() != "" {
+				var err error
+				if rules, err = LoadRules(rulesFile.Load()); err != nil {
+					return err
+				}
+			}
+			ruleEngine.Set(rules)
+			return nil
+		})
+		config.Live("backend_host_map", func() error {
+			return hostMaps[backendValue].Set(backendHostMap.Load())
+		})
+		config.Live("frontend_host_map", func() error {
+			return hostMaps[frontendValue].Set(frontendHostMap.Load())
+		})
+		// With -autoscale_workers, the new bounds apply on the next step
+		config.Live("backend_workers", func() error {
+			if !*autoscaleWorkers {
+				backends.Resize(nBackendWorkers.Load())
+			}
+			return nil
+		})
+		config.Live("frontend_workers", func() error {
+			if !*autoscaleWorkers {
+				frontends.Resize(nFrontendWorkers.Load())
+			}
+			return nil
+		})
+		config.Live("backend_workers_max", nil)
+		config.Live("frontend_workers_max", nil)
+		config.Live("autoscale_backlog", nil)
+		config.Live("autoscale_latency", nil)
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go config.Watch(hup)
+	}
+
+	// Serve the admin API on its own listener, or along with the metrics
+	admin := &AdminServer{
+		Token: *adminToken,
+		// Without authentication, a TCP listener is too exposed to let
+		// anyone change the state of purged
+		ReadOnly:   adminReadOnly(*adminAddr, *adminToken),
+		Ingresses:  ingresses,
+		Queue:      queue,
+		ChFrontend: chFrontend,
+		Spool:      spool,
+		Filter:     filter,
+	}
+	if *adminAddr != "" {
+		ln, err := listen(*adminAddr, *adminSocketMode)
+		if err != nil {
+			mainLog.Fatal("Error listening for the admin API", "addr", *adminAddr, "err", err)
+		}
+		go http.Serve(ln, admin.Handler())
 	} else {
-		re = nil
+		http.Handle(adminPrefix, admin.Handler())
+	}
+	if admin.ReadOnly {
+		mainLog.Warn("Admin API served read-only, set -admin_token or a unix: -admin_addr to control purged")
 	}
-	startWorkers(*backendAddr, *frontendAddr, chBackend, chFrontend, re)
 
-	log.Printf("Process purged started with %d backend and %d frontend workers. Metrics at %s/metrics\n", *nBackendWorkers, *nFrontendWorkers, *metricsAddr)
+	// Serve /healthz and /readyz along with the metrics
+	health := &Health{
+		Queue:         queue,
+		Spool:         spool,
+		ChFrontend:    chFrontend,
+		MaxBacklog:    *healthMaxBacklog,
+		WorkerTimeout: time.Duration(*healthWorkerTime) * time.Second,
+	}
+	http.Handle("/healthz", health.LivenessHandler())
+	http.Handle("/readyz", health.ReadinessHandler())
+
+	// On SIGTERM and SIGINT, stop the readers and wait for the queued purges
+	// to be sent. Closing the kafka consumer commits the offsets
+	shutdown := &Shutdown{
+		Timeout:    time.Duration(*shutdownTimeout) * time.Second,
+		Sources:    sources,
+		ChIngress:  chIngress,
+		Queue:      queue,
+		ChFrontend: chFrontend,
+		Spool:      spool,
+		Kafka:      kafkaProducer,
+		Offsets:    offsets,
+	}
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigchan
+		mainLog.Info("Exiting on signal", "signal", sig)
+		shutdown.Run()
+		tracer.Flush(time.Second)
+		os.Exit(0)
+	}()
+
+	mainLog.Info("Process purged started", "backend_workers", nBackendWorkers.Load(), "frontend_workers", nFrontendWorkers.Load(), "metrics", *metricsAddr+"/metrics")
 
 	for {
 		// Update purged_backlog metric
 		time.Sleep(1000 * time.Millisecond)
 
-		backlog.With(prometheus.Labels{layerLabel: backendValue}).Set(float64(len(chBackend)))
-		backlog.With(prometheus.Labels{layerLabel: frontendValue}).Set(float64(len(chFrontend)))
+		for class, n := range queue.Len() {
+			backlog.With(prometheus.Labels{layerLabel: backendValue, priorityLabel: class}).Set(float64(n))
+		}
+		backlog.With(prometheus.Labels{layerLabel: frontendValue, priorityLabel: ""}).Set(float64(len(chFrontend)))
+		if spool != nil {
+			spool.UpdateMetrics()
+		}
 		if *kafkaTopics != "" {
 			for _, topic := range strings.Split(*kafkaTopics, ",") {
 				purgeLag.With(prometheus.Labels{"topic": topic}).Set(kafkaProducer.GetLag(topic))
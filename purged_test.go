@@ -17,11 +17,16 @@
 package main
 
 import (
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"sync"
 	"time"
 
 	"testing"
@@ -54,7 +59,7 @@ func TestSendPurge(t *testing.T) {
 	assertEquals(t, status, "200")
 	assertEquals(t, err, nil)
 
-	httpClient := NewHTTPPurger(parsedURL.Host)
+	httpClient := NewHTTPPurger(parsedURL.Host, httpPurgerOptions)
 	status, err = httpClient.Send("en.wikipedia.org", "/wiki/Main_Page")
 	assertEquals(t, status, "200")
 	assertEquals(t, err, nil)
@@ -84,7 +89,7 @@ func BenchmarkHTTPSendPurge(b *testing.B) {
 
 	parsedURL, _ := url.Parse(server.URL)
 
-	httpClient := NewHTTPPurger(parsedURL.Host)
+	httpClient := NewHTTPPurger(parsedURL.Host, httpPurgerOptions)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -110,34 +115,49 @@ func assertListEquals(t *testing.T, a, b []string) {
 func testWorkersWrapper(t *testing.T, re *regexp.Regexp, input []string, expected []string) {
 	var feURLs []string
 	var beURLs []string
+	var mutex sync.Mutex
 	expectedLen := len(expected)
 
 	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
 		beURLs = append(beURLs, req.URL.String())
+		mutex.Unlock()
 		rw.Write([]byte(`OK`))
 	}))
 	defer backend.Close()
 	backendURL, _ := url.Parse(backend.URL)
 
 	frontend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
 		feURLs = append(feURLs, req.URL.String())
+		mutex.Unlock()
 		rw.Write([]byte(`OK`))
 	}))
 	defer frontend.Close()
 	frontendURL, _ := url.Parse(frontend.URL)
 
-	testCh := make(chan string, 10)
-	testFrCh := make(chan url.URL, 10)
+	testCh := make(chan Purge, 10)
+	testFrCh := make(chan Purge, 10)
 
 	for _, url := range input {
-		testCh <- url
+		testCh <- Purge{URL: url}
 	}
 
-	startWorkers(backendURL.Host, frontendURL.Host, testCh, testFrCh, re)
+	backends, frontends := startWorkers(backendURL.Host, frontendURL.Host, testCh, testFrCh, NewHostFilter(re))
+	defer backends.Resize(0)
+	defer frontends.Resize(0)
 
 	// Wait for all URLs in the channel to be consumed
-	for ; len(feURLs) < expectedLen || len(beURLs) < expectedLen; time.Sleep(100 * time.Millisecond) {
+	received := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(feURLs) >= expectedLen && len(beURLs) >= expectedLen
 	}
+	for ; !received(); time.Sleep(100 * time.Millisecond) {
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
 
 	assertEquals(t, len(feURLs), len(beURLs))
 	assertEquals(t, len(feURLs), expectedLen)
@@ -182,9 +202,12 @@ func TestWorkersRegexp(t *testing.T) {
 // in isolation (ie: independently from frontendWorker)
 func TestBackendWorker(t *testing.T) {
 	var beURLs []string
+	var mutex sync.Mutex
 
 	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
 		beURLs = append(beURLs, req.URL.String())
+		mutex.Unlock()
 		rw.Write([]byte(`OK`))
 	}))
 	defer backend.Close()
@@ -195,21 +218,125 @@ func TestBackendWorker(t *testing.T) {
 		"https://it.wikipedia.org/wiki/Pagina_principale",
 	}
 
-	testCh := make(chan string, 10)
-	testFrCh := make(chan url.URL, 10)
+	testCh := make(chan Purge, 10)
+	testFrCh := make(chan Purge, 10)
 
 	for _, url := range input {
-		testCh <- url
+		testCh <- Purge{URL: url}
 	}
 
-	// backendWorker never returns
-	go backendWorker(backendURL.Host, testCh, testFrCh, nil)
+	quit := make(chan struct{})
+	defer close(quit)
+	go backendWorker(backendURL.Host, testCh, testFrCh, nil, quit)
 
 	// Wait for all the purges to be received by the test server
-	for ; len(beURLs) < len(input); time.Sleep(100 * time.Millisecond) {
+	received := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(beURLs)
 	}
+	for ; received() < len(input); time.Sleep(100 * time.Millisecond) {
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
 
 	if beURLs[0] != "/wiki/Main_Page" || beURLs[1] != "/wiki/Pagina_principale" {
 		t.Errorf("Unexpected beURLs: %v", beURLs)
 	}
 }
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * time.Minute)
+
+	*purgeMaxAge = 60
+	multicastMaxAge.Set("0")
+	defer func() { *purgeMaxAge = 0 }()
+
+	assertEquals(t, expired(Purge{Source: kafkaValue, EventTime: old, Received: now}, now), true)
+	assertEquals(t, expired(Purge{Source: kafkaValue, EventTime: now, Received: old}, now), false)
+	// Without an event time
+	assertEquals(t, expired(Purge{Source: kafkaValue, Received: old}, now), false)
+	// Multicast purges never expire by default
+	assertEquals(t, expired(Purge{Source: multicastValue, Received: old}, now), false)
+	assertEquals(t, expired(Purge{Source: httpValue, Received: old}, now), false)
+
+	multicastMaxAge.Set("180")
+	defer multicastMaxAge.Set("0")
+	assertEquals(t, expired(Purge{Source: multicastValue, Received: old}, now), false)
+	multicastMaxAge.Set("60")
+	assertEquals(t, expired(Purge{Source: multicastValue, Received: old}, now), true)
+}
+
+// Purges which expired while queued are not sent
+func TestBackendWorkerExpired(t *testing.T) {
+	var beURLs []string
+	var mutex sync.Mutex
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		beURLs = append(beURLs, req.URL.String())
+		mutex.Unlock()
+		rw.Write([]byte(`OK`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	*purgeMaxAge = 60
+	defer func() { *purgeMaxAge = 0 }()
+
+	testCh := make(chan Purge, 10)
+	testFrCh := make(chan Purge, 10)
+	testCh <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue, EventTime: time.Now().Add(-time.Hour)}
+	testCh <- Purge{URL: "https://it.wikipedia.org/wiki/Pagina_principale", Source: kafkaValue, EventTime: time.Now()}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	go backendWorker(backendURL.Host, testCh, testFrCh, nil, quit)
+
+	// Wait for the fresh purge to be sent to the frontend
+	p := <-testFrCh
+	assertEquals(t, p.URL, "https://it.wikipedia.org/wiki/Pagina_principale")
+	mutex.Lock()
+	defer mutex.Unlock()
+	assertEquals(t, len(beURLs), 1)
+	assertEquals(t, beURLs[0], "/wiki/Pagina_principale")
+}
+
+func TestSplitAddr(t *testing.T) {
+	network, address := splitAddr("127.0.0.1:3128")
+	assertEquals(t, network, "tcp")
+	assertEquals(t, address, "127.0.0.1:3128")
+
+	network, address = splitAddr("unix:/run/trafficserver/purge.sock")
+	assertEquals(t, network, "unix")
+	assertEquals(t, address, "/run/trafficserver/purge.sock")
+}
+
+func TestSendPurgeUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-unix")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "purge.sock")
+	ln, err := net.Listen("unix", path)
+	assertNotErr(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assertEquals(t, req.URL.String(), "/wiki/Main_Page")
+		assertEquals(t, req.Method, "PURGE")
+		assertEquals(t, req.Host, "en.wikipedia.org")
+		rw.Write([]byte(`OK`))
+	}))
+	server.Listener = ln
+	server.Start()
+	defer server.Close()
+
+	for _, client := range []PurgeClient{NewTCPPurger("unix:" + path), NewHTTPPurger("unix:"+path, httpPurgerOptions)} {
+		status, err := client.Send("en.wikipedia.org", "/wiki/Main_Page")
+		assertEquals(t, status, "200")
+		assertNotErr(t, err)
+		client.Close()
+	}
+}
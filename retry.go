@@ -0,0 +1,120 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// What to do with the frontend when a purge failed on the backend
+	purgeFrontend = "purge"
+	skipFrontend  = "skip"
+)
+
+var (
+	retriedPurges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged_retried_total",
+		Help: "Total number of purges retried after failing with an error or 5xx response",
+	}, []string{
+		layerLabel,
+	})
+	failedPurges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged_failed_total",
+		Help: "Total number of purges given up on after failing -retry_attempts times",
+	}, []string{
+		layerLabel,
+	})
+	retryBacklog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "purged_retry_backlog",
+		Help: "Number of failed purges waiting to be retried",
+	}, []string{
+		layerLabel,
+	})
+)
+
+// checkBackendFailure returns an error if policy is not a valid
+// -frontend_on_backend_failure value.
+func checkBackendFailure(policy string) error {
+	if policy != purgeFrontend && policy != skipFrontend {
+		return fmt.Errorf("Unknown policy %q, expected %s or %s", policy, purgeFrontend, skipFrontend)
+	}
+	return nil
+}
+
+// checkStatus returns an error if the cache answered host with a server
+// error, so that the purge is retried.
+func checkStatus(host, status string, err error) error {
+	if err == nil && strings.HasPrefix(status, "5") {
+		return fmt.Errorf("Server error purging %s: %s", host, status)
+	}
+	return err
+}
+
+// retryDelay returns how long to wait before retrying a purge which failed
+// the given number of times: -retry_backoff, doubled on each further attempt
+// up to -retry_max_backoff.
+func retryDelay(attempts int) time.Duration {
+	delay := time.Duration(retryBackoff.Load()) * time.Millisecond
+	max := time.Duration(retryMaxBackoff.Load()) * time.Millisecond
+
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// giveUp records that p failed on layer for good in its audit record and
+// trace, so that its result is failed even if it is still sent to the
+// frontend.
+func giveUp(p Purge, layer string, err error) {
+	now := time.Now()
+	p.Audit.failed(layer)
+	tracer.Stage(p, "", layer+" failed", internalSpan, now, now, fmt.Errorf("Giving up after %d attempts: %v", p.attempts+1, err))
+}
+
+// retryPurge schedules p, which failed on layer, to be sent again on chout
+// after a backoff. It returns false if p failed -retry_attempts times
+// already, and should be given up on.
+func retryPurge(chout chan Purge, p Purge, layer string) bool {
+	labels := prometheus.Labels{layerLabel: layer}
+
+	if p.attempts >= retryAttempts.Load() {
+		failedPurges.With(labels).Inc()
+		return false
+	}
+
+	p.attempts++
+	retriedPurges.With(labels).Inc()
+	retryBacklog.With(labels).Inc()
+
+	send := delayedPurge(chout, p)
+	time.AfterFunc(retryDelay(p.attempts), func() {
+		retryBacklog.With(labels).Dec()
+		send()
+	})
+	return true
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckStatus(t *testing.T) {
+	assertNotErr(t, checkStatus("en.wikipedia.org", "200", nil))
+	assertNotErr(t, checkStatus("en.wikipedia.org", "404", nil))
+	expectErr(t, checkStatus("en.wikipedia.org", "503", nil))
+
+	err := errors.New("connection refused")
+	assertEquals(t, checkStatus("en.wikipedia.org", "", err), err)
+}
+
+func TestCheckBackendFailure(t *testing.T) {
+	assertNotErr(t, checkBackendFailure(purgeFrontend))
+	assertNotErr(t, checkBackendFailure(skipFrontend))
+	expectErr(t, checkBackendFailure("retry"))
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryBackoff.Set("100")
+	retryMaxBackoff.Set("350")
+	defer retryBackoff.Set("1000")
+	defer retryMaxBackoff.Set("60000")
+
+	assertEquals(t, retryDelay(1), 100*time.Millisecond)
+	assertEquals(t, retryDelay(2), 200*time.Millisecond)
+	assertEquals(t, retryDelay(3), 350*time.Millisecond)
+	assertEquals(t, retryDelay(30), 350*time.Millisecond)
+}
+
+// setupRetryTest starts a backend worker sending purges to a server which
+// fails the first failures requests. It returns a function counting the
+// requests received by the server, and one stopping both.
+func setupRetryTest(failures int64, chin, chout chan Purge) (func() int64, func()) {
+	var requests int64
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt64(&requests, 1) <= failures {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	backendURL, _ := url.Parse(backend.URL)
+
+	retryAttempts.Set("2")
+	retryBackoff.Set("10")
+
+	quit := make(chan struct{})
+	go backendWorker(backendURL.Host, chin, chout, nil, quit)
+
+	return func() int64 {
+			return atomic.LoadInt64(&requests)
+		}, func() {
+			close(quit)
+			backend.Close()
+			retryAttempts.Set("0")
+			retryBackoff.Set("1000")
+		}
+}
+
+// Failed purges are retried before being sent to the frontend
+func TestBackendWorkerRetry(t *testing.T) {
+	chin := make(chan Purge, 10)
+	chout := make(chan Purge, 10)
+	requests, stop := setupRetryTest(2, chin, chout)
+	defer stop()
+
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+
+	p := <-chout
+	assertEquals(t, p.URL, "https://en.wikipedia.org/wiki/Main_Page")
+	assertEquals(t, p.attempts, 0)
+	assertEquals(t, requests(), int64(3))
+}
+
+// Purges failing on the backend after all retries are only sent to the
+// frontend with the purge policy
+func TestBackendWorkerFailure(t *testing.T) {
+	chin := make(chan Purge, 10)
+	chout := make(chan Purge, 10)
+	requests, stop := setupRetryTest(10, chin, chout)
+	defer stop()
+
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Audit: &AuditRecord{}}
+	p := <-chout
+	assertEquals(t, p.URL, "https://en.wikipedia.org/wiki/Main_Page")
+	assertEquals(t, requests(), int64(3))
+	// The failure is recorded, whatever the outcome on the frontend
+	assertEquals(t, p.Audit.BackendStatus, "503")
+	assertEquals(t, p.Audit.BackendFailed, true)
+	p.Audit.sent(frontendValue, "200", nil, time.Now())
+	assertEquals(t, p.Audit.BackendFailed, true)
+
+	backendFailure.Set(skipFrontend)
+	defer backendFailure.Set(purgeFrontend)
+
+	chin <- Purge{URL: "https://it.wikipedia.org/wiki/Pagina_principale"}
+	for ; requests() < 6; time.Sleep(10 * time.Millisecond) {
+	}
+	time.Sleep(100 * time.Millisecond)
+	assertEquals(t, len(chout), 0)
+}
@@ -0,0 +1,234 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	allowAction       = "allow"
+	denyAction        = "deny"
+	rewriteHostAction = "rewrite-host"
+	rewritePathAction = "rewrite-path"
+	routeAction       = "route"
+
+	ruleLabel = "rule"
+)
+
+var ruleHits = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "purged_rule_hits_total",
+	Help: "Total number of purges matching each rule",
+}, []string{
+	ruleLabel,
+})
+
+// Rule performs an action on the purges matching all of its conditions.
+// Conditions left empty match any purge.
+type Rule struct {
+	Name   string
+	Action string
+	Host   *regexp.Regexp
+	Path   string
+	Query  *regexp.Regexp
+	Source string
+	// New host for rewrite-host, replacement of Path for rewrite-path, layer
+	// for route
+	To string
+}
+
+func (r *Rule) match(p Purge, u *url.URL) bool {
+	return (r.Host == nil || r.Host.MatchString(u.Host)) &&
+		strings.HasPrefix(u.Path, r.Path) &&
+		(r.Query == nil || r.Query.MatchString(u.RawQuery)) &&
+		(r.Source == "" || r.Source == p.Source)
+}
+
+// parseRule parses a rule in the form "action [name=N] [host=REGEX]
+// [path=PREFIX] [query=REGEX] [source=S] [to=V]".
+func parseRule(line string, defaultName string) (*Rule, error) {
+	fields := strings.Fields(line)
+	r := &Rule{Name: defaultName, Action: fields[0]}
+
+	for _, field := range fields[1:] {
+		i := strings.Index(field, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("Invalid condition %q, expected key=value", field)
+		}
+
+		key, value := field[:i], field[i+1:]
+		var err error
+		switch key {
+		case "name":
+			r.Name = value
+		case "host":
+			r.Host, err = regexp.Compile(value)
+		case "path":
+			r.Path = value
+		case "query":
+			r.Query, err = regexp.Compile(value)
+		case "source":
+			r.Source = value
+		case "to":
+			r.To = value
+		default:
+			return nil, fmt.Errorf("Unknown key %q", key)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch r.Action {
+	case allowAction, denyAction:
+	case rewriteHostAction:
+		if r.To == "" {
+			return nil, fmt.Errorf("%s requires to=", r.Action)
+		}
+	case rewritePathAction:
+		if r.Path == "" {
+			return nil, fmt.Errorf("%s requires path=", r.Action)
+		}
+	case routeAction:
+		if r.To != backendValue && r.To != frontendValue {
+			return nil, fmt.Errorf("%s requires to=%s or to=%s", r.Action, backendValue, frontendValue)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown action %q", r.Action)
+	}
+
+	return r, nil
+}
+
+// RuleSet is an ordered list of rules. Rewrites are applied and evaluation
+// continues with the next rule, while allow, deny and route stop it. Purges
+// matching no terminal rule are allowed.
+type RuleSet []*Rule
+
+// LoadRules reads a RuleSet from a file with one rule per line. Empty lines
+// and lines starting with # are ignored. Rules without a name are named after
+// their line number.
+func LoadRules(path string) (RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules RuleSet
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRule(line, fmt.Sprintf("line%d", n))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// Decision is the outcome of evaluating a RuleSet on a purge.
+type Decision struct {
+	Purge   Purge
+	Allowed bool
+	// Names of the matching rules, in order
+	Matched []string
+}
+
+// Evaluate returns the decision of rs on p.
+func (rs RuleSet) Evaluate(p Purge) Decision {
+	d := Decision{Purge: p, Allowed: true}
+
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		// Discarded later on by the workers
+		return d
+	}
+
+	for _, r := range rs {
+		if !r.match(d.Purge, u) {
+			continue
+		}
+
+		d.Matched = append(d.Matched, r.Name)
+
+		switch r.Action {
+		case allowAction:
+			return d
+		case denyAction:
+			d.Allowed = false
+			return d
+		case routeAction:
+			d.Purge.Layer = r.To
+			return d
+		case rewriteHostAction:
+			u.Host = r.To
+		case rewritePathAction:
+			u.Path = r.To + strings.TrimPrefix(u.Path, r.Path)
+			u.RawPath = ""
+		}
+		d.Purge.URL = u.String()
+	}
+
+	return d
+}
+
+// RuleEngine holds the RuleSet applied to incoming purges, which can be
+// changed at runtime. A nil RuleEngine allows all purges unchanged.
+type RuleEngine struct {
+	rules atomic.Value
+}
+
+func NewRuleEngine(rules RuleSet) *RuleEngine {
+	e := &RuleEngine{}
+	e.Set(rules)
+	return e
+}
+
+func (e *RuleEngine) Set(rules RuleSet) {
+	e.rules.Store(rules)
+}
+
+// Apply returns p after applying the rules, and false if p must be discarded.
+func (e *RuleEngine) Apply(p Purge) (Purge, bool) {
+	if e == nil {
+		return p, true
+	}
+
+	d := e.rules.Load().(RuleSet).Evaluate(p)
+	for _, name := range d.Matched {
+		ruleHits.With(prometheus.Labels{ruleLabel: name}).Inc()
+	}
+
+	return d.Purge, d.Allowed
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testRules = `
+# Internal wikis are never purged
+deny name=private host=^private\.
+rewrite-host host=^en\.m\.wikipedia\.org$ to=en.wikipedia.org
+rewrite-path name=short path=/w/ to=/wiki/
+route host=^upload\. to=backend
+deny query=^action=raw source=multicast
+allow host=\.wikipedia\.org$
+deny
+`
+
+func setupRulesTest(t *testing.T, content string) (RuleSet, error) {
+	dir, err := ioutil.TempDir("", "purged-rules")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules")
+	ioutil.WriteFile(path, []byte(content), 0644)
+	return LoadRules(path)
+}
+
+func TestLoadRules(t *testing.T) {
+	rules, err := setupRulesTest(t, testRules)
+	assertNotErr(t, err)
+	assertEquals(t, len(rules), 7)
+	assertEquals(t, rules[0].Name, "private")
+	assertEquals(t, rules[1].Name, "line4")
+
+	_, err = setupRulesTest(t, "reject host=^private\\.")
+	expectErr(t, err)
+	_, err = setupRulesTest(t, "deny host=[")
+	expectErr(t, err)
+	_, err = setupRulesTest(t, "deny hostname=private")
+	expectErr(t, err)
+	_, err = setupRulesTest(t, "rewrite-path to=/wiki/")
+	expectErr(t, err)
+	_, err = setupRulesTest(t, "route host=^upload\\. to=origin")
+	expectErr(t, err)
+}
+
+func TestRulesEvaluate(t *testing.T) {
+	rules, err := setupRulesTest(t, testRules)
+	assertNotErr(t, err)
+
+	d := rules.Evaluate(Purge{URL: "https://private.wikimedia.org/wiki/Main_Page"})
+	assertEquals(t, d.Allowed, false)
+	assertEquals(t, d.Matched[0], "private")
+
+	d = rules.Evaluate(Purge{URL: "https://en.m.wikipedia.org/w/Main_Page"})
+	assertEquals(t, d.Allowed, true)
+	assertEquals(t, d.Purge.URL, "https://en.wikipedia.org/wiki/Main_Page")
+	assertEquals(t, len(d.Matched), 3)
+
+	d = rules.Evaluate(Purge{URL: "https://upload.wikimedia.org/a/a9/Example.jpg"})
+	assertEquals(t, d.Allowed, true)
+	assertEquals(t, d.Purge.Layer, backendValue)
+
+	d = rules.Evaluate(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page?action=raw", Source: multicastValue})
+	assertEquals(t, d.Allowed, false)
+	d = rules.Evaluate(Purge{URL: "https://en.wikipedia.org/wiki/Main_Page?action=raw", Source: kafkaValue})
+	assertEquals(t, d.Allowed, true)
+
+	d = rules.Evaluate(Purge{URL: "https://www.mediawiki.org/wiki/MediaWiki"})
+	assertEquals(t, d.Allowed, false)
+	assertEquals(t, d.Matched[0], "line9")
+
+	// Without rules, everything is allowed
+	d = RuleSet(nil).Evaluate(Purge{URL: "https://www.mediawiki.org/wiki/MediaWiki"})
+	assertEquals(t, d.Allowed, true)
+	assertEquals(t, len(d.Matched), 0)
+}
+
+func TestIngressRules(t *testing.T) {
+	rules, err := setupRulesTest(t, "deny host=^private\\.\n")
+	assertNotErr(t, err)
+
+	out := make(chanQueue, 10)
+	ing, _ := NewIngress(kafkaValue, map[string]string{}, out, nil)
+	ing.Rules = NewRuleEngine(rules)
+
+	chin := make(chan Purge, 10)
+	chin <- Purge{URL: "https://private.wikimedia.org/wiki/Main_Page"}
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+	close(chin)
+	ing.Run(chin)
+
+	assertEquals(t, len(out), 1)
+	assertEquals(t, (<-out).URL, "https://en.wikipedia.org/wiki/Main_Page")
+}
+
+// Purges routed to a single layer are only sent there
+func TestBackendWorkerLayer(t *testing.T) {
+	var received int32
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&received, 1)
+		rw.Write([]byte(`OK`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	frontendDelay.Set("0")
+	defer frontendDelay.Set("1000")
+
+	testCh := make(chan Purge, 10)
+	testFrCh := make(chan Purge, 10)
+	testCh <- Purge{URL: "https://upload.wikimedia.org/a/a9/Example.jpg", Layer: backendValue}
+	testCh <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Layer: frontendValue}
+	testCh <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	go backendWorker(backendURL.Host, testCh, testFrCh, nil, quit)
+
+	p := <-testFrCh
+	assertEquals(t, p.Layer, frontendValue)
+	p = <-testFrCh
+	assertEquals(t, p.Layer, "")
+
+	time.Sleep(100 * time.Millisecond)
+	assertEquals(t, atomic.LoadInt32(&received), int32(2))
+	assertEquals(t, len(testFrCh), 0)
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How often to check whether the queues are empty on shutdown
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Shutdown stops purged gracefully. Readers are stopped first, so that no new
+// purges come in, then the queued purges are sent to the caches until all
+// queues are empty or Timeout expires. With a spool, the purges not yet read
+// from it are persisted instead of sent. The Kafka consumer is closed last,
+// committing the offsets of the purges processed.
+type Shutdown struct {
+	Timeout time.Duration
+	// Channels between each reader and its Ingress
+	Sources []chan Purge
+	// Channel between the Ingresses and the spool, if any
+	ChIngress  chan Purge
+	Queue      *PriorityQueue
+	ChFrontend chan Purge
+	Spool      *PrioritySpool
+	// Kafka consumer, closed once the purges read have been processed so
+	// that their offsets are committed
+	Kafka   *KafkaReader
+	Offsets *OffsetTracker
+}
+
+// ingressBacklog returns the number of purges not yet queued or spooled.
+func (s *Shutdown) ingressBacklog() int {
+	n := len(s.ChIngress)
+	for _, c := range s.Sources {
+		n += len(c)
+	}
+	return n
+}
+
+// backlog returns the number of purges not yet sent to all layers.
+func (s *Shutdown) backlog() int {
+	n := s.ingressBacklog() + s.Queue.Pending() + len(s.ChFrontend) + int(atomic.LoadInt64(&delayedPurges))
+	for _, w := range workerSnapshots() {
+		if w.State == sendingState {
+			n++
+		}
+	}
+	return n
+}
+
+// wait returns once backlog is zero, or at deadline. As purges are handed
+// over between goroutines without being counted, backlog needs to be zero
+// twice in a row.
+func wait(deadline time.Time, backlog func() int) {
+	empty := 0
+	for time.Now().Before(deadline) {
+		if backlog() == 0 {
+			empty++
+		} else {
+			empty = 0
+		}
+
+		if empty == 2 {
+			return
+		}
+
+		time.Sleep(shutdownPollInterval)
+	}
+}
+
+// stopReaders stops all readers, waiting for them until deadline.
+func stopReaders(deadline time.Time) {
+	readersMutex.Lock()
+	defer readersMutex.Unlock()
+
+	for _, reader := range readers {
+		if reader.stop != nil {
+			go reader.stop()
+		}
+	}
+
+	for _, reader := range readers {
+		select {
+		case <-reader.finished:
+		case <-time.After(time.Until(deadline)):
+			mainLog.Warn("Timed out waiting for reader to stop", "source", reader.name)
+		}
+	}
+}
+
+// closeWorkers closes the connections of all workers to the caches.
+func closeWorkers() {
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+
+	for _, status := range workers {
+		status.mutex.Lock()
+		if status.client != nil {
+			status.client.Close()
+		}
+		status.mutex.Unlock()
+	}
+}
+
+// Run shuts down purged, returning the number of purges abandoned.
+func (s *Shutdown) Run() int {
+	deadline := time.Now().Add(s.Timeout)
+
+	mainLog.Info("Shutting down, stopping readers")
+	stopReaders(deadline)
+
+	if s.Spool != nil {
+		wait(deadline, s.ingressBacklog)
+		mainLog.Info("Persisting purges in the spool", "purges", s.Spool.Len())
+		s.Spool.Close()
+	}
+
+	mainLog.Info("Sending queued purges", "purges", s.backlog())
+	wait(deadline, s.backlog)
+
+	abandoned := s.backlog()
+	closeWorkers()
+
+	if s.Kafka != nil {
+		wait(deadline, s.Offsets.Pending)
+		mainLog.Info("Committing Kafka offsets", "pending", s.Offsets.Pending())
+		if err := s.Kafka.Close(); err != nil {
+			mainLog.Error("Error closing the Kafka consumer", "err", err)
+		}
+	}
+
+	mainLog.Info("Shutdown complete", "abandoned", abandoned)
+	return abandoned
+}
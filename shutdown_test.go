@@ -0,0 +1,158 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func setupShutdownTest(t *testing.T, timeout time.Duration) (*Shutdown, chan Purge) {
+	queue, err := NewPriorityQueue("normal:1", "", "normal", 10)
+	assertNotErr(t, err)
+
+	source := make(chan Purge, 10)
+	in, _ := NewIngress(kafkaValue, map[string]string{}, queue, nil)
+	go in.Run(source)
+
+	return &Shutdown{
+		Timeout:    timeout,
+		Sources:    []chan Purge{source},
+		Queue:      queue,
+		ChFrontend: make(chan Purge, 10),
+	}, source
+}
+
+func TestShutdownStopsReaders(t *testing.T) {
+	saved := readers
+	readers = nil
+	defer func() { readers = saved }()
+
+	s, source := setupShutdownTest(t, time.Second)
+
+	done := make(chan struct{})
+	status := registerReader(kafkaValue, func() { close(done) })
+	go func() {
+		<-done
+		source <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+		status.stopped()
+	}()
+
+	// The purge sent by the reader before stopping is not sent, as there are
+	// no workers
+	start := time.Now()
+	assertEquals(t, s.Run(), 1)
+	assertEquals(t, time.Since(start) >= time.Second, true)
+	assertEquals(t, s.Queue.Pending(), 1)
+}
+
+func TestShutdownDrains(t *testing.T) {
+	saved := readers
+	readers = nil
+	defer func() { readers = saved }()
+
+	s, source := setupShutdownTest(t, 10*time.Second)
+	for i := 0; i < 5; i++ {
+		source <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+	}
+	s.ChFrontend <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+
+	chBackend := make(chan Purge)
+	go s.Queue.Run(chBackend)
+	go func() {
+		for p := range chBackend {
+			s.ChFrontend <- p
+		}
+	}()
+	go func() {
+		for range s.ChFrontend {
+		}
+	}()
+
+	assertEquals(t, s.Run(), 0)
+	assertEquals(t, s.Queue.Pending(), 0)
+	assertEquals(t, len(source), 0)
+}
+
+func TestShutdownPersistsSpool(t *testing.T) {
+	saved := readers
+	readers = nil
+	defer func() { readers = saved }()
+
+	dir, err := ioutil.TempDir("", "purged-shutdown")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, _ := NewPriorityQueue("normal:1", "", "normal", 10)
+	spool, err := NewPrioritySpool(dir, 1<<20, 1<<16, spoolDropNewest, queue)
+	assertNotErr(t, err)
+
+	source := make(chan Purge, 10)
+	s := &Shutdown{
+		Timeout:    time.Second,
+		Sources:    []chan Purge{source},
+		ChIngress:  make(chan Purge, 10),
+		Queue:      queue,
+		ChFrontend: make(chan Purge, 10),
+		Spool:      spool,
+	}
+
+	// Nothing is read from the spool, as there are no workers
+	go func() {
+		for p := range s.ChIngress {
+			spool.PutPurge(p)
+		}
+	}()
+	in, _ := NewIngress(kafkaValue, map[string]string{}, chanQueue(s.ChIngress), spool)
+	go in.Run(source)
+
+	for i := 0; i < 3; i++ {
+		source <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+	}
+
+	assertEquals(t, s.Run(), 0)
+
+	spool, err = NewPrioritySpool(dir, 1<<20, 1<<16, spoolDropNewest, queue)
+	assertNotErr(t, err)
+	defer spool.Close()
+	assertEquals(t, spool.Len(), int64(3))
+}
+
+func TestShutdownCommitsProcessed(t *testing.T) {
+	saved := readers
+	readers = nil
+	defer func() { readers = saved }()
+
+	s, _ := setupShutdownTest(t, 10*time.Second)
+	kr, mr := setupKafkaReaderTest(nil, false)
+	kr.Offsets = NewOffsetTracker()
+	s.Kafka, s.Offsets = kr, kr.Offsets
+
+	// The consumer is only closed once the purge read has been processed
+	p := kr.Offsets.Track(kafkaPurge(0, 41))
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		kr.Offsets.Done(p)
+	}()
+
+	assertEquals(t, s.Run(), 0)
+	assertEquals(t, mr.IsClosed, true)
+	assertEquals(t, len(mr.Stored), 1)
+	assertEquals(t, int64(mr.Stored[0].Offset), int64(42))
+}
@@ -0,0 +1,749 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	spoolBlock      = "block"
+	spoolDropNewest = "drop-newest"
+	spoolDropOldest = "drop-oldest"
+
+	segmentSuffix   = ".seg"
+	checkpointFile  = "checkpoint"
+	recordHeaderLen = 12
+	// How many entries can be read before the read position is saved to
+	// disk. After a crash, at most this many entries are purged twice.
+	checkpointInterval = 1000
+)
+
+var (
+	errSpoolFull   = errors.New("Spool is full")
+	errSpoolClosed = errors.New("Spool is closed")
+
+	spoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "purged_spool_bytes",
+		Help: "Size of the on-disk spool in bytes",
+	})
+	spoolEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "purged_spool_entries",
+		Help: "Number of spooled purges still to be processed",
+	})
+	spoolAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "purged_spool_age_seconds",
+		Help: "Time spent in the spool by the oldest unprocessed purge",
+	})
+	spoolDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "purged_spool_dropped_total",
+		Help: "Total number of purges dropped because the spool was full",
+	})
+
+	spoolLog = NewLogger("spool")
+)
+
+// segment is a spool file. Entries are appended to the newest segment only.
+type segment struct {
+	id      int64
+	size    int64
+	entries int64
+}
+
+// Spool is an append-only on-disk queue of purges. Entries are written to
+// numbered segment files and read back in order; the read position is
+// periodically saved to a checkpoint file, so that entries not yet handed
+// to the workers are replayed after a restart or a crash. Segments and the
+// checkpoint are synced to disk when rotated and saved respectively, so
+// entries written since are only durable across a crash of purged, not of
+// the host.
+//
+// Once handed to the workers, purges are held in memory only: those waiting
+// for -frontend_delay, or to be retried, are lost on crash.
+//
+// Each entry is stored as an 8 bytes timestamp (UnixNano), a 4 bytes length
+// and the payload, all big endian.
+type Spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	overflow     string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// Segments on disk, oldest first. The last one is being written, the
+	// first one is being read.
+	segments []*segment
+	size     int64
+	entries  int64
+	w        *os.File
+	r        *os.File
+	// Read offset and number of entries already read in segments[0]
+	roff      int64
+	rconsumed int64
+	// Entries read since the last checkpoint
+	unsaved int
+	closed  bool
+}
+
+// NewSpool opens the spool stored in dir, creating it if needed. Entries
+// left unprocessed by a previous run are returned first by Get.
+func NewSpool(dir string, maxBytes, segmentBytes int64, overflow string) (*Spool, error) {
+	switch overflow {
+	case spoolBlock, spoolDropNewest, spoolDropOldest:
+	default:
+		return nil, fmt.Errorf("Unknown spool overflow policy %q", overflow)
+	}
+
+	// Room is made one segment at a time
+	if segmentBytes > maxBytes {
+		return nil, fmt.Errorf("Spool segment size %d larger than the spool size %d", segmentBytes, maxBytes)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes, segmentBytes: segmentBytes, overflow: overflow}
+	s.cond = sync.NewCond(&s.mu)
+
+	rid, roff, err := s.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// ReadDir sorts by filename, segment names are zero-padded so that
+	// sorting them by name sorts them by id
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), segmentSuffix) {
+			continue
+		}
+
+		id, err := strconv.ParseInt(strings.TrimSuffix(fi.Name(), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if id < rid {
+			// Fully processed before the last checkpoint
+			os.Remove(s.segmentPath(id))
+			continue
+		}
+
+		seg, consumed, err := s.scanSegment(id, roff)
+		if err != nil {
+			return nil, err
+		}
+
+		if id == rid {
+			s.roff = roff
+			s.rconsumed = consumed
+		}
+
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+		s.entries += seg.entries
+	}
+	s.entries -= s.rconsumed
+
+	if len(s.segments) > 0 && s.segments[0].id != rid {
+		// The checkpointed segment is gone, start from the beginning of the
+		// oldest one
+		s.roff, s.rconsumed = 0, 0
+		s.entries = 0
+		for _, seg := range s.segments {
+			s.entries += seg.entries
+		}
+	}
+
+	// Never append to segments written by a previous run, their tail
+	// might have been truncated
+	nextID := rid
+	if len(s.segments) > 0 {
+		nextID = s.segments[len(s.segments)-1].id + 1
+	}
+
+	if err := s.newSegment(nextID); err != nil {
+		return nil, err
+	}
+
+	if s.r, err = os.Open(s.segmentPath(s.segments[0].id)); err != nil {
+		return nil, err
+	}
+
+	if s.entries > 0 {
+		spoolLog.Info("Replaying spooled purges", "dir", dir, "entries", s.entries)
+	}
+
+	return s, nil
+}
+
+func (s *Spool) segmentPath(id int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// readCheckpoint returns the segment id and offset of the next entry to read.
+func (s *Spool) readCheckpoint() (int64, int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, checkpointFile))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var id, offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &id, &offset); err != nil {
+		return 0, 0, fmt.Errorf("Invalid spool checkpoint: %v", err)
+	}
+
+	return id, offset, nil
+}
+
+// syncDir flushes the entries of dir to disk, making files created, renamed
+// or removed in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFileSync writes data to path and flushes it to disk.
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// checkpoint saves the current read position. Must be called with s.mu held.
+func (s *Spool) checkpoint() {
+	path := filepath.Join(s.dir, checkpointFile)
+	data := fmt.Sprintf("%d %d\n", s.segments[0].id, s.roff)
+
+	// The entries written so far must not be lost once the read position
+	// is saved
+	err := s.w.Sync()
+
+	// Write and rename, so that a crash never leaves a partial checkpoint
+	if err == nil {
+		err = writeFileSync(path+".tmp", []byte(data))
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+
+	if err != nil {
+		spoolLog.Error("Error saving spool checkpoint", "err", err)
+	}
+
+	s.unsaved = 0
+}
+
+// scanSegment counts the entries in the given segment, and how many of them
+// end before offset. A partially written entry at the end of the file is
+// truncated.
+func (s *Spool) scanSegment(id int64, offset int64) (*segment, int64, error) {
+	data, err := ioutil.ReadFile(s.segmentPath(id))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seg := &segment{id: id}
+	var consumed int64
+	for seg.size+recordHeaderLen <= int64(len(data)) {
+		payloadLen := int64(binary.BigEndian.Uint32(data[seg.size+8:]))
+		end := seg.size + recordHeaderLen + payloadLen
+		if end > int64(len(data)) {
+			break
+		}
+
+		seg.size = end
+		seg.entries++
+		if end <= offset {
+			consumed++
+		}
+	}
+
+	if seg.size < int64(len(data)) {
+		spoolLog.Warn("Truncating partial entry", "file", s.segmentPath(id), "bytes", int64(len(data))-seg.size)
+		if err := os.Truncate(s.segmentPath(id), seg.size); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return seg, consumed, nil
+}
+
+// newSegment creates a new segment and starts writing to it. Must be called
+// with s.mu held.
+func (s *Spool) newSegment(id int64) error {
+	w, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if s.w != nil {
+		// The previous segment is complete, flush it
+		if err := s.w.Sync(); err != nil {
+			spoolLog.Error("Error syncing spool segment", "err", err)
+		}
+		s.w.Close()
+	}
+
+	s.w = w
+	s.segments = append(s.segments, &segment{id: id})
+	if err := syncDir(s.dir); err != nil {
+		spoolLog.Error("Error syncing spool directory", "err", err)
+	}
+	return nil
+}
+
+// nextSegment removes the segment being read, which must have been fully
+// consumed, and starts reading the following one. Must be called with s.mu
+// held.
+func (s *Spool) nextSegment() error {
+	s.r.Close()
+	os.Remove(s.segmentPath(s.segments[0].id))
+	s.size -= s.segments[0].size
+	s.segments = s.segments[1:]
+	s.roff, s.rconsumed = 0, 0
+	s.checkpoint()
+
+	// Room has been made for blocked writers
+	s.cond.Broadcast()
+
+	var err error
+	s.r, err = os.Open(s.segmentPath(s.segments[0].id))
+	return err
+}
+
+// reclaim removes the segment being read if it has been fully consumed,
+// starting a new segment first if it is also the one being written. It
+// returns false if there was nothing to reclaim. Must be called with s.mu
+// held.
+func (s *Spool) reclaim() bool {
+	if s.segments[0].size == 0 || s.roff < s.segments[0].size {
+		return false
+	}
+
+	if len(s.segments) == 1 {
+		if err := s.newSegment(s.segments[0].id + 1); err != nil {
+			spoolLog.Error("Error starting spool segment", "err", err)
+			return false
+		}
+	}
+
+	if err := s.nextSegment(); err != nil {
+		spoolLog.Error("Error removing consumed spool segment", "err", err)
+	}
+	return true
+}
+
+// dropOldest removes the oldest segment to make room for new entries,
+// returning false if there is no segment that can be removed. Must be called
+// with s.mu held.
+func (s *Spool) dropOldest() bool {
+	if len(s.segments) < 2 {
+		return false
+	}
+
+	dropped := s.segments[0].entries - s.rconsumed
+	if err := s.nextSegment(); err != nil {
+		spoolLog.Error("Error dropping oldest spool segment", "err", err)
+	}
+
+	s.entries -= dropped
+	spoolDropped.Add(float64(dropped))
+	return true
+}
+
+// Put appends payload to the spool. If the spool is full, the configured
+// overflow policy is applied: Put either waits for room to be made, drops
+// the oldest segment or returns errSpoolFull.
+func (s *Spool) Put(payload []byte) error {
+	rec := make([]byte, recordHeaderLen+len(payload))
+	binary.BigEndian.PutUint64(rec, uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(rec[8:], uint32(len(payload)))
+	copy(rec[recordHeaderLen:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.size+int64(len(rec)) > s.maxBytes {
+		if s.closed {
+			return errSpoolClosed
+		}
+
+		// The entries read so far no longer need to be kept
+		if s.reclaim() {
+			continue
+		}
+
+		if s.overflow == spoolBlock {
+			s.cond.Wait()
+			continue
+		}
+
+		if s.overflow == spoolDropOldest && s.dropOldest() {
+			continue
+		}
+
+		spoolDropped.Inc()
+		return errSpoolFull
+	}
+
+	if s.closed {
+		return errSpoolClosed
+	}
+
+	cur := s.segments[len(s.segments)-1]
+	if cur.size > 0 && cur.size+int64(len(rec)) > s.segmentBytes {
+		if err := s.newSegment(cur.id + 1); err != nil {
+			return err
+		}
+		cur = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := s.w.Write(rec); err != nil {
+		return err
+	}
+
+	cur.size += int64(len(rec))
+	cur.entries++
+	s.size += int64(len(rec))
+	s.entries++
+
+	s.cond.Broadcast()
+	return nil
+}
+
+// Get returns the oldest unprocessed entry and the time it was spooled,
+// waiting for one to be available if the spool is empty.
+func (s *Spool) Get() ([]byte, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.closed {
+			return nil, time.Time{}, errSpoolClosed
+		}
+
+		if s.roff < s.segments[0].size {
+			break
+		}
+
+		if len(s.segments) > 1 {
+			if err := s.nextSegment(); err != nil {
+				return nil, time.Time{}, err
+			}
+			continue
+		}
+
+		s.cond.Wait()
+	}
+
+	header := make([]byte, recordHeaderLen)
+	if _, err := s.r.ReadAt(header, s.roff); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(header)))
+	payload := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := s.r.ReadAt(payload, s.roff+recordHeaderLen); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	s.roff += recordHeaderLen + int64(len(payload))
+	s.rconsumed++
+	s.entries--
+
+	if s.entries == 0 {
+		// Blocked writers can reclaim the space of the entries read
+		s.cond.Broadcast()
+	}
+
+	s.unsaved++
+	if s.unsaved >= checkpointInterval {
+		s.checkpoint()
+	}
+
+	return payload, ts, nil
+}
+
+// Len returns the number of entries still to be read.
+func (s *Spool) Len() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries
+}
+
+// Drain discards all unprocessed entries, returning how many.
+func (s *Spool) Drain() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	drained := s.entries
+	for len(s.segments) > 1 {
+		if err := s.nextSegment(); err != nil {
+			spoolLog.Error("Error draining spool", "err", err)
+			break
+		}
+	}
+
+	s.roff = s.segments[0].size
+	s.rconsumed = s.segments[0].entries
+	s.entries = 0
+	s.checkpoint()
+
+	return drained
+}
+
+// stats returns the size of the spool in bytes, the number of entries still
+// to be read and for how long the oldest of them has been spooled.
+func (s *Spool) stats() (int64, int64, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.entries == 0 {
+		return s.size, s.entries, 0
+	}
+
+	for s.roff == s.segments[0].size && len(s.segments) > 1 {
+		if err := s.nextSegment(); err != nil {
+			return s.size, s.entries, 0
+		}
+	}
+
+	var age time.Duration
+	header := make([]byte, recordHeaderLen)
+	if _, err := s.r.ReadAt(header, s.roff); err == nil {
+		age = time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(header))))
+	}
+	return s.size, s.entries, age
+}
+
+// Close saves the read position and closes the spool. Blocked calls to Put
+// and Get return errSpoolClosed.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+	s.checkpoint()
+	s.cond.Broadcast()
+	s.r.Close()
+	return s.w.Close()
+}
+
+// PutPurge appends p to the spool. Once spooled, the Kafka offset of p is
+// considered processed.
+func (s *Spool) PutPurge(p Purge) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Put(payload); err != nil {
+		return err
+	}
+	p.offsets.Done(p)
+	return nil
+}
+
+// GetPurge returns the oldest unprocessed purge.
+func (s *Spool) GetPurge() (Purge, error) {
+	var p Purge
+	payload, _, err := s.Get()
+	if err != nil {
+		return p, err
+	}
+	return p, json.Unmarshal(payload, &p)
+}
+
+// Replay sends the spooled purges to out once the workers are ready to
+// process them, until the spool is closed. Their audit records, if any, are
+// written to auditLog.
+func (s *Spool) Replay(out Queue, auditLog *AuditLog) {
+	for {
+		p, err := s.GetPurge()
+		if err == errSpoolClosed {
+			return
+		}
+
+		if _, ok := err.(*json.SyntaxError); ok {
+			spoolLog.Warn("Discarding invalid spool entry", "err", err)
+			continue
+		}
+
+		if err != nil {
+			spoolLog.Error("Error reading from spool", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if p.Audit != nil {
+			p.Audit.log = auditLog
+		}
+		out.Push(p)
+	}
+}
+
+// PrioritySpool spools purges separately for each class of a PriorityQueue,
+// in a subdirectory named after the class. Each class is replayed on its
+// own, so that the backlog of a class does not hold back the purges of the
+// others.
+type PrioritySpool struct {
+	queue  *PriorityQueue
+	spools map[string]*Spool
+
+	// Audit log of the replayed purges, if any
+	AuditLog *AuditLog
+}
+
+// NewPrioritySpool opens the spools of all classes of queue in dir. Each
+// class can hold up to maxBytes.
+func NewPrioritySpool(dir string, maxBytes, segmentBytes int64, overflow string, queue *PriorityQueue) (*PrioritySpool, error) {
+	s := &PrioritySpool{queue: queue, spools: make(map[string]*Spool, len(queue.classes))}
+
+	for _, class := range queue.classes {
+		spool, err := NewSpool(filepath.Join(dir, class.name), maxBytes, segmentBytes, overflow)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.spools[class.name] = spool
+	}
+
+	return s, nil
+}
+
+// PutPurge appends p to the spool of its class.
+func (s *PrioritySpool) PutPurge(p Purge) error {
+	return s.spools[s.queue.Classify(p)].PutPurge(p)
+}
+
+// Len returns the number of entries still to be read in all classes.
+func (s *PrioritySpool) Len() int64 {
+	var n int64
+	for _, spool := range s.spools {
+		n += spool.Len()
+	}
+	return n
+}
+
+// Drain discards all unprocessed entries, returning how many.
+func (s *PrioritySpool) Drain() int64 {
+	var n int64
+	for _, spool := range s.spools {
+		n += spool.Drain()
+	}
+	return n
+}
+
+// UpdateMetrics sets the spool size and age gauges, the age being the one of
+// the oldest purge in any class.
+func (s *PrioritySpool) UpdateMetrics() {
+	var size, entries int64
+	var age time.Duration
+
+	for _, spool := range s.spools {
+		ssize, sentries, sage := spool.stats()
+		size += ssize
+		entries += sentries
+		if sage > age {
+			age = sage
+		}
+	}
+
+	spoolBytes.Set(float64(size))
+	spoolEntries.Set(float64(entries))
+	spoolAge.Set(age.Seconds())
+}
+
+// Close closes the spools of all classes.
+func (s *PrioritySpool) Close() error {
+	var err error
+	for _, spool := range s.spools {
+		if cerr := spool.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Replay replays each class to the queue in the background, until the spool
+// is closed.
+func (s *PrioritySpool) Replay() {
+	for _, spool := range s.spools {
+		go spool.Replay(s.queue, s.AuditLog)
+	}
+}
+
+// Run spools the purges received on chin and replays each class to the
+// queue.
+func (s *PrioritySpool) Run(chin chan Purge) {
+	s.Replay()
+
+	for p := range chin {
+		err := s.PutPurge(p)
+		if err != nil {
+			finishPurge(p, droppedResult)
+		}
+		if err != nil && err != errSpoolFull && err != errSpoolClosed {
+			spoolLog.Error("Error writing to spool", "err", err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func setupSpoolTest(t *testing.T, maxBytes, segmentBytes int64, overflow string) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "purged-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err := NewSpool(dir, maxBytes, segmentBytes, overflow)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return spool, dir
+}
+
+func spoolGet(t *testing.T, spool *Spool) string {
+	payload, _, err := spool.Get()
+	assertNotErr(t, err)
+	return string(payload)
+}
+
+func TestSpoolPutGet(t *testing.T) {
+	spool, dir := setupSpoolTest(t, 1<<20, 64, spoolDropNewest)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	// Small segments so that entries span several files
+	for i := 0; i < 10; i++ {
+		assertNotErr(t, spool.Put([]byte(fmt.Sprintf("https://en.wikipedia.org/wiki/%d", i))))
+	}
+	assertEquals(t, spool.Len(), int64(10))
+
+	for i := 0; i < 10; i++ {
+		assertEquals(t, spoolGet(t, spool), fmt.Sprintf("https://en.wikipedia.org/wiki/%d", i))
+	}
+	assertEquals(t, spool.Len(), int64(0))
+}
+
+// Entries that were not read before closing the spool are returned after
+// opening it again
+func TestSpoolReplay(t *testing.T) {
+	spool, dir := setupSpoolTest(t, 1<<20, 64, spoolDropNewest)
+	defer os.RemoveAll(dir)
+
+	input := []string{
+		"https://en.wikipedia.org/wiki/Main_Page",
+		"https://it.wikipedia.org/wiki/Pagina_principale",
+		"https://upload.wikimedia.org/wikipedia/commons/a/a9/Example.jpg",
+	}
+
+	for _, url := range input {
+		assertNotErr(t, spool.Put([]byte(url)))
+	}
+
+	assertEquals(t, spoolGet(t, spool), input[0])
+	assertNotErr(t, spool.Close())
+
+	spool, err := NewSpool(dir, 1<<20, 64, spoolDropNewest)
+	assertNotErr(t, err)
+	defer spool.Close()
+
+	assertEquals(t, spoolGet(t, spool), input[1])
+	assertEquals(t, spoolGet(t, spool), input[2])
+}
+
+// A partially written entry, for instance because of a crash, is ignored
+func TestSpoolTruncatedEntry(t *testing.T) {
+	spool, dir := setupSpoolTest(t, 1<<20, 1<<10, spoolDropNewest)
+	defer os.RemoveAll(dir)
+
+	assertNotErr(t, spool.Put([]byte("https://en.wikipedia.org/wiki/Main_Page")))
+	spool.w.Write([]byte{0, 0, 0})
+	assertNotErr(t, spool.Close())
+
+	spool, err := NewSpool(dir, 1<<20, 1<<10, spoolDropNewest)
+	assertNotErr(t, err)
+	defer spool.Close()
+
+	assertEquals(t, spool.Len(), int64(1))
+	assertEquals(t, spoolGet(t, spool), "https://en.wikipedia.org/wiki/Main_Page")
+}
+
+func TestSpoolDropNewest(t *testing.T) {
+	// Room for two entries
+	spool, dir := setupSpoolTest(t, 2*(recordHeaderLen+4), 2*(recordHeaderLen+4), spoolDropNewest)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	assertNotErr(t, spool.Put([]byte("aaaa")))
+	assertNotErr(t, spool.Put([]byte("bbbb")))
+	assertEquals(t, spool.Put([]byte("cccc")), errSpoolFull)
+
+	assertEquals(t, spoolGet(t, spool), "aaaa")
+	assertEquals(t, spoolGet(t, spool), "bbbb")
+}
+
+func TestSpoolSegmentSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-spool")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewSpool(dir, 100, 1000, spoolBlock)
+	expectErr(t, err)
+}
+
+// Once read, the entries of the segment being written make room for new ones
+func TestSpoolReclaim(t *testing.T) {
+	for _, overflow := range []string{spoolBlock, spoolDropNewest, spoolDropOldest} {
+		// Room for two entries, in a single segment
+		spool, dir := setupSpoolTest(t, 2*(recordHeaderLen+4), 2*(recordHeaderLen+4), overflow)
+
+		assertNotErr(t, spool.Put([]byte("aaaa")))
+		assertNotErr(t, spool.Put([]byte("bbbb")))
+		assertEquals(t, spoolGet(t, spool), "aaaa")
+		assertEquals(t, spoolGet(t, spool), "bbbb")
+
+		done := make(chan error, 2)
+		go func() {
+			done <- spool.Put([]byte("cccc"))
+			done <- spool.Put([]byte("dddd"))
+		}()
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-done:
+				assertNotErr(t, err)
+			case <-time.After(time.Second):
+				t.Fatalf("%s: Put blocked on a drained spool", overflow)
+			}
+		}
+
+		assertEquals(t, spool.Len(), int64(2))
+		assertEquals(t, spoolGet(t, spool), "cccc")
+		assertEquals(t, spoolGet(t, spool), "dddd")
+
+		// Also once the last entry is read while a writer is waiting
+		assertNotErr(t, spool.Put([]byte("eeee")))
+		assertNotErr(t, spool.Put([]byte("ffff")))
+		if overflow == spoolBlock {
+			go func() {
+				done <- spool.Put([]byte("gggg"))
+			}()
+			assertEquals(t, spoolGet(t, spool), "eeee")
+			assertEquals(t, spoolGet(t, spool), "ffff")
+			assertNotErr(t, <-done)
+			assertEquals(t, spoolGet(t, spool), "gggg")
+		}
+
+		spool.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSpoolDropOldest(t *testing.T) {
+	// One entry per segment, room for two segments
+	spool, dir := setupSpoolTest(t, 2*(recordHeaderLen+4), recordHeaderLen+4, spoolDropOldest)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	assertNotErr(t, spool.Put([]byte("aaaa")))
+	assertNotErr(t, spool.Put([]byte("bbbb")))
+	assertNotErr(t, spool.Put([]byte("cccc")))
+
+	assertEquals(t, spoolGet(t, spool), "bbbb")
+	assertEquals(t, spoolGet(t, spool), "cccc")
+}
+
+func TestSpoolBlock(t *testing.T) {
+	spool, dir := setupSpoolTest(t, 2*(recordHeaderLen+4), recordHeaderLen+4, spoolBlock)
+	defer os.RemoveAll(dir)
+	defer spool.Close()
+
+	assertNotErr(t, spool.Put([]byte("aaaa")))
+	assertNotErr(t, spool.Put([]byte("bbbb")))
+
+	done := make(chan error)
+	go func() {
+		done <- spool.Put([]byte("cccc"))
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Put did not block on a full spool")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Reading past the first segment makes room for the blocked writer
+	assertEquals(t, spoolGet(t, spool), "aaaa")
+	assertEquals(t, spoolGet(t, spool), "bbbb")
+	assertNotErr(t, <-done)
+	assertEquals(t, spoolGet(t, spool), "cccc")
+}
+
+func TestPrioritySpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "purged-spool")
+	assertNotErr(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := NewPriorityQueue("urgent:2,normal:1", "source=multicast:urgent", "normal", 1)
+	assertNotErr(t, err)
+	spool, err := NewPrioritySpool(dir, 1<<20, 1<<10, spoolBlock, queue)
+	assertNotErr(t, err)
+	spool.AuditLog = &AuditLog{}
+
+	chin := make(chan Purge)
+	go spool.Run(chin)
+
+	// The normal class backlog does not hold back urgent purges
+	for i := 0; i < 3; i++ {
+		chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue, Topic: "topic1"}
+	}
+	chin <- Purge{URL: "https://it.wikipedia.org/wiki/Pagina_principale", Source: multicastValue, Audit: &AuditRecord{}}
+
+	for deadline := time.Now().Add(time.Second); queue.Len()["urgent"] == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertEquals(t, queue.Len()["urgent"], 1)
+	assertEquals(t, queue.Len()["normal"], 1)
+
+	chout := make(chan Purge)
+	go queue.Run(chout)
+	p := <-chout
+	assertEquals(t, p.URL, "https://it.wikipedia.org/wiki/Pagina_principale")
+	assertEquals(t, p.Source, multicastValue)
+	// Replayed audit records are written to the audit log
+	assertEquals(t, p.Audit.log, spool.AuditLog)
+
+	p = <-chout
+	assertEquals(t, p.URL, "https://en.wikipedia.org/wiki/Main_Page")
+	assertEquals(t, p.Topic, "topic1")
+
+	close(chin)
+	spool.Close()
+
+	_, err = os.Stat(filepath.Join(dir, "urgent", checkpointFile))
+	assertNotErr(t, err)
+	_, err = os.Stat(filepath.Join(dir, "normal", checkpointFile))
+	assertNotErr(t, err)
+}
@@ -0,0 +1,184 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// HTTP method and header names
+var tokenRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// Headers set by purged, or framing the request, which templates cannot set
+var reservedHeaders = map[string]bool{
+	"Host":              true,
+	"User-Agent":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Traceparent":       true,
+	banHeader:           true,
+}
+
+var (
+	// Schemes sent with -purge_all_schemes
+	allSchemes = []string{"http", "https"}
+
+	// The request template of purgers not configured otherwise
+	defaultTemplate = &RequestTemplate{Method: "PURGE"}
+
+	// Request templates by layer
+	requestTemplates = map[string]*RequestTemplate{
+		backendValue:  defaultTemplate,
+		frontendValue: defaultTemplate,
+	}
+)
+
+// PurgeRequest is an exact purge to send to a cache.
+type PurgeRequest struct {
+	Host string
+	URI  string
+	// Scheme of the purged URL
+	Scheme string
+	// W3C traceparent header, if the purge is traced
+	Traceparent string
+}
+
+// RequestPurgeClient is a PurgeClient sending exact purges according to a
+// RequestTemplate.
+type RequestPurgeClient interface {
+	SendRequest(r PurgeRequest) (string, error)
+}
+
+type templateHeader struct {
+	name  string
+	value string
+}
+
+// RequestTemplate describes the exact purge requests sent to a cache layer.
+// Its extra headers, such as authentication tokens, are also sent along with
+// bans and surrogate key purges.
+type RequestTemplate struct {
+	Method string
+	// Extra headers, in the order they are sent
+	Headers []templateHeader
+	// Header carrying the scheme of the purged URL, if any
+	SchemeHeader string
+}
+
+// checkHeaderName returns an error if name is not a valid header name, or
+// one of the reservedHeaders.
+func checkHeaderName(name string) error {
+	if !tokenRegex.MatchString(name) {
+		return fmt.Errorf("Invalid header name %q", name)
+	}
+	if reservedHeaders[http.CanonicalHeaderKey(name)] {
+		return fmt.Errorf("Header %s cannot be set", name)
+	}
+	return nil
+}
+
+// NewRequestTemplate returns a RequestTemplate sending requests with the
+// given method. headers is a comma separated list of Name:value pairs, the
+// values cannot contain commas.
+func NewRequestTemplate(method, headers, schemeHeader string) (*RequestTemplate, error) {
+	if !tokenRegex.MatchString(method) {
+		return nil, fmt.Errorf("Invalid method %q", method)
+	}
+
+	if schemeHeader != "" {
+		if err := checkHeaderName(schemeHeader); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &RequestTemplate{Method: method, SchemeHeader: schemeHeader}
+	for _, item := range strings.Split(headers, ",") {
+		if item == "" {
+			continue
+		}
+
+		i := strings.Index(item, ":")
+		if i == -1 {
+			return nil, fmt.Errorf("Expected Name:value header, got %q", item)
+		}
+
+		h := templateHeader{name: strings.TrimSpace(item[:i]), value: strings.TrimSpace(item[i+1:])}
+		if err := checkHeaderName(h.name); err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(h.value, "\r\n") {
+			return nil, fmt.Errorf("Invalid value of header %s", h.name)
+		}
+
+		t.Headers = append(t.Headers, h)
+	}
+
+	return t, nil
+}
+
+// headers returns all the headers to send along with r, besides Host and
+// User-Agent.
+func (t *RequestTemplate) headers(r PurgeRequest) []templateHeader {
+	headers := t.Headers
+	if t.SchemeHeader != "" && r.Scheme != "" {
+		headers = append(headers[:len(headers):len(headers)], templateHeader{t.SchemeHeader, r.Scheme})
+	}
+	if r.Traceparent != "" {
+		headers = append(headers[:len(headers):len(headers)], templateHeader{"traceparent", r.Traceparent})
+	}
+	return headers
+}
+
+// rawHeaders returns the extra headers of t as raw HTTP/1.1 header lines.
+func (t *RequestTemplate) rawHeaders() string {
+	var b strings.Builder
+	for _, h := range t.Headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.name, h.value)
+	}
+	return b.String()
+}
+
+// setExtraHeaders sets the extra headers of t on req.
+func (t *RequestTemplate) setExtraHeaders(req *http.Request) {
+	for _, h := range t.Headers {
+		req.Header.Set(h.name, h.value)
+	}
+}
+
+// raw returns r as a raw HTTP/1.1 request.
+func (t *RequestTemplate) raw(r PurgeRequest) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: purged\r\n", t.Method, r.URI, r.Host)
+	for _, h := range t.headers(r) {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.name, h.value)
+	}
+	b.WriteString("\r\n")
+
+	return b.String()
+}
+
+// setHeaders sets the headers of r on req.
+func (t *RequestTemplate) setHeaders(req *http.Request, r PurgeRequest) {
+	for _, h := range t.headers(r) {
+		req.Header.Set(h.name, h.value)
+	}
+}
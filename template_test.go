@@ -0,0 +1,227 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewRequestTemplate(t *testing.T) {
+	tmpl, err := NewRequestTemplate("REFRESH", "X-Purge-Token: secret,X-Cache-Cluster:text", "X-Forwarded-Proto")
+	assertNotErr(t, err)
+	assertEquals(t, tmpl.Method, "REFRESH")
+	assertEquals(t, len(tmpl.Headers), 2)
+	assertEquals(t, tmpl.Headers[0], templateHeader{"X-Purge-Token", "secret"})
+	assertEquals(t, tmpl.Headers[1], templateHeader{"X-Cache-Cluster", "text"})
+	assertEquals(t, tmpl.SchemeHeader, "X-Forwarded-Proto")
+
+	tmpl, err = NewRequestTemplate("PURGE", "", "")
+	assertNotErr(t, err)
+	assertEquals(t, len(tmpl.Headers), 0)
+
+	for _, args := range [][3]string{
+		{"", "", ""},
+		{"PURGE /", "", ""},
+		{"PURGE", "X-Purge-Token", ""},
+		{"PURGE", "X Purge Token:secret", ""},
+		{"PURGE", "X-Purge-Token:secret\r\nHost: evil", ""},
+		{"PURGE", "", "X-Forwarded-Proto:"},
+		// Set by purged, or framing the request
+		{"PURGE", "Host:evil", ""},
+		{"PURGE", "user-agent:evil", ""},
+		{"PURGE", "Content-Length:0", ""},
+		{"PURGE", "Transfer-Encoding:chunked", ""},
+		{"PURGE", "X-Purge-Token:secret,Connection:close", ""},
+		{"PURGE", "", "Host"},
+		{"PURGE", "X-Ban-Expression:obj.http.x-host ~ .", ""},
+	} {
+		_, err = NewRequestTemplate(args[0], args[1], args[2])
+		expectErr(t, err)
+	}
+}
+
+func TestRequestTemplateRaw(t *testing.T) {
+	r := PurgeRequest{Host: "en.wikipedia.org", URI: "/wiki/Main_Page", Scheme: "https"}
+
+	assertEquals(t, defaultTemplate.raw(r), "PURGE /wiki/Main_Page HTTP/1.1\r\nHost: en.wikipedia.org\r\nUser-Agent: purged\r\n\r\n")
+
+	tmpl, err := NewRequestTemplate("REFRESH", "X-Purge-Token:secret", "X-Forwarded-Proto")
+	assertNotErr(t, err)
+	r.Traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	assertEquals(t, tmpl.raw(r), "REFRESH /wiki/Main_Page HTTP/1.1\r\nHost: en.wikipedia.org\r\nUser-Agent: purged\r\n"+
+		"X-Purge-Token: secret\r\nX-Forwarded-Proto: https\r\ntraceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n\r\n")
+
+	// The template is left untouched
+	assertEquals(t, len(tmpl.Headers), 1)
+}
+
+func TestSendTemplate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assertEquals(t, req.Method, "REFRESH")
+		assertEquals(t, req.Host, "en.wikipedia.org")
+		assertEquals(t, req.URL.String(), "/wiki/Main_Page")
+		assertEquals(t, req.Header.Get("X-Purge-Token"), "secret")
+		assertEquals(t, req.Header.Get("X-Forwarded-Proto"), "https")
+		rw.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+	parsedURL, _ := url.Parse(server.URL)
+	purgeURL, _ := url.Parse("https://en.wikipedia.org/wiki/Main_Page")
+
+	tmpl, err := NewRequestTemplate("REFRESH", "X-Purge-Token:secret", "X-Forwarded-Proto")
+	assertNotErr(t, err)
+
+	*nethttp = false
+	tcpClient := newPurgeClient(parsedURL.Host, varnishValue, tmpl)
+	*nethttp = true
+	defer func() { *nethttp = false }()
+	httpClient := newPurgeClient(parsedURL.Host, varnishValue, tmpl)
+
+	for _, client := range []PurgeClient{tcpClient, httpClient, NewATSRevalidator(tcpClient, "", 0)} {
+		status, err := sendPurgeHost(client, backendValue, Purge{URL: purgeURL.String()}, "en.wikipedia.org", "https", purgeURL, "")
+		assertEquals(t, status, "200")
+		assertNotErr(t, err)
+	}
+}
+
+// The extra headers of the template are sent along with bans and surrogate
+// key purges too
+func TestSendTemplateBanKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assertEquals(t, req.Header.Get("X-Purge-Token"), "secret")
+		if req.Method == "BAN" {
+			assertEquals(t, req.Header.Get(banHeader), "obj.http.x-host == upload.wikimedia.org && obj.http.x-url ~ ^(?:/wikipedia/commons/thumb/7/78/)")
+		} else {
+			assertEquals(t, req.Method, "PURGE")
+			assertEquals(t, req.Header.Get("xkey-purge"), "page:123")
+		}
+		rw.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+	parsedURL, _ := url.Parse(server.URL)
+
+	tmpl, err := NewRequestTemplate("REFRESH", "X-Purge-Token:secret", "")
+	assertNotErr(t, err)
+
+	*nethttp = false
+	tcpClient := newPurgeClient(parsedURL.Host, varnishValue, tmpl)
+	*nethttp = true
+	defer func() { *nethttp = false }()
+	httpClient := newPurgeClient(parsedURL.Host, varnishValue, tmpl)
+
+	for _, client := range []PurgeClient{tcpClient, httpClient} {
+		status, err := client.Ban("upload.wikimedia.org", "^/wikipedia/commons/thumb/7/78/")
+		assertEquals(t, status, "200")
+		assertNotErr(t, err)
+
+		status, err = client.PurgeKeys("en.wikipedia.org", []string{"page:123"})
+		assertEquals(t, status, "200")
+		assertNotErr(t, err)
+	}
+}
+
+// The scheme of purged URLs is sent to the caches
+func TestBackendWorkerSchemes(t *testing.T) {
+	var mutex sync.Mutex
+	var schemes []string
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		schemes = append(schemes, req.URL.Path+" "+req.Header.Get("X-Forwarded-Proto"))
+		mutex.Unlock()
+		rw.Write([]byte(`OK`))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	tmpl, err := NewRequestTemplate("PURGE", "", "X-Forwarded-Proto")
+	assertNotErr(t, err)
+	requestTemplates[backendValue] = tmpl
+	defer func() { requestTemplates[backendValue] = defaultTemplate }()
+
+	chin := make(chan Purge, 10)
+	chout := make(chan Purge, 10)
+	quit := make(chan struct{})
+	defer close(quit)
+	go backendWorker(backendURL.Host, chin, chout, nil, quit)
+
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+	chin <- Purge{URL: "http://en.wikipedia.org/wiki/Pagina_principale"}
+	<-chout
+	<-chout
+
+	// Both schemes, only for exact purges
+	*purgeAllSchemes = true
+	defer func() { *purgeAllSchemes = false }()
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Francesco_Totti"}
+	chin <- Purge{URL: "https://en.wikipedia.org/", Kind: xkeyKind, Keys: []string{"Q42"}}
+	<-chout
+	<-chout
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assertListEquals(t, schemes, []string{
+		"/wiki/Main_Page https",
+		"/wiki/Pagina_principale http",
+		"/wiki/Francesco_Totti http",
+		"/wiki/Francesco_Totti https",
+		"/ ",
+	})
+}
+
+// Layers without a scheme header are purged once with -purge_all_schemes
+func TestFrontendWorkerSchemes(t *testing.T) {
+	var mutex sync.Mutex
+	var paths []string
+
+	frontend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		paths = append(paths, req.URL.Path)
+		mutex.Unlock()
+		rw.Write([]byte(`OK`))
+	}))
+	defer frontend.Close()
+	frontendURL, _ := url.Parse(frontend.URL)
+
+	*purgeAllSchemes = true
+	defer func() { *purgeAllSchemes = false }()
+
+	chin := make(chan Purge, 10)
+	quit := make(chan struct{})
+	defer close(quit)
+	go frontendWorker(frontendURL.Host, chin, quit)
+
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Francesco_Totti"}
+
+	received := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(paths)
+	}
+	for deadline := time.Now().Add(5 * time.Second); received() < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assertListEquals(t, paths, []string{"/wiki/Main_Page", "/wiki/Francesco_Totti"})
+}
@@ -0,0 +1,412 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// OTLP span kinds
+	internalSpan = 1
+	clientSpan   = 3
+	consumerSpan = 5
+
+	// OTLP status code of failed spans
+	errorStatus = 2
+
+	// Spans buffered before being dropped
+	spanBufferLen = 4096
+	// Maximum number of spans in an export request, and how often to export
+	spanBatchLen       = 512
+	spanExportInterval = 5 * time.Second
+)
+
+var (
+	exportedSpans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "purged_trace_spans_total",
+		Help: "Total number of trace spans by outcome of their export",
+	}, []string{
+		statusLabel,
+	})
+
+	// The Tracer, if tracing is enabled
+	tracer *Tracer
+
+	traceLog       = NewLogger("tracing")
+	exportErrorLog = traceLog.Limited()
+)
+
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Trace follows a sampled purge through the pipeline. All stages are
+// recorded as children of a root span covering the whole life of the purge.
+type Trace struct {
+	TraceID string
+	RootID  string
+	// When the previous stage ended, and whether any stage failed
+	mark   time.Time
+	failed bool
+}
+
+// newSpanID returns the ID of a new span of t, or an empty string if t is
+// nil.
+func (t *Trace) newSpanID() string {
+	if t == nil {
+		return ""
+	}
+	return randomID(8)
+}
+
+// traceparent returns the W3C Trace Context header for spanID, or an empty
+// string if t is nil.
+func (t *Trace) traceparent(spanID string) string {
+	if t == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", t.TraceID, spanID)
+}
+
+// span is a finished span, waiting to be exported.
+type span struct {
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []string
+	err      string
+}
+
+// Tracer exports the spans of the stages of sampled purges to an OTLP/HTTP
+// collector, in the JSON encoding. A nil Tracer traces nothing.
+type Tracer struct {
+	endpoint string
+	service  string
+	client   http.Client
+	spans    chan span
+	flush    chan chan struct{}
+}
+
+// NewTracer returns a Tracer exporting spans to the OTLP/HTTP traces
+// endpoint, eg: http://127.0.0.1:4318/v1/traces
+func NewTracer(endpoint, service string) *Tracer {
+	return &Tracer{
+		endpoint: endpoint,
+		service:  service,
+		client:   http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan span, spanBufferLen),
+		flush:    make(chan chan struct{}),
+	}
+}
+
+// Start returns the Trace of p, or nil if p is not to be traced. A fraction
+// -otel_sample_rate of the purges is traced.
+func (t *Tracer) Start(p Purge) *Trace {
+	if t == nil || mathrand.Float64() >= otelSampleRate.Load() {
+		return nil
+	}
+
+	trace := &Trace{TraceID: randomID(16), RootID: randomID(8)}
+	trace.mark = p.Received
+	if trace.mark.IsZero() {
+		trace.mark = time.Now()
+	}
+	return trace
+}
+
+// record queues a span for export, dropping it if the buffer is full.
+func (t *Tracer) record(s span) {
+	select {
+	case t.spans <- s:
+	default:
+		exportedSpans.With(prometheus.Labels{statusLabel: droppedResult}).Inc()
+	}
+}
+
+// Stage records a span of p ending at end. The span starts at start or, if
+// zero, at the end of the previous stage. A span ID is generated if spanID is
+// empty. attrs are key-value pairs.
+func (t *Tracer) Stage(p Purge, spanID, name string, kind int, start, end time.Time, err error, attrs ...string) {
+	if t == nil || p.Trace == nil {
+		return
+	}
+
+	if spanID == "" {
+		spanID = p.Trace.newSpanID()
+	}
+
+	if start.IsZero() {
+		start = p.Trace.mark
+	}
+	if start.IsZero() {
+		// Not known after going through the spool
+		start = end
+	}
+
+	s := span{
+		traceID:  p.Trace.TraceID,
+		spanID:   spanID,
+		parentID: p.Trace.RootID,
+		name:     name,
+		kind:     kind,
+		start:    start,
+		end:      end,
+		attrs:    attrs,
+	}
+	if err != nil {
+		s.err = err.Error()
+		p.Trace.failed = true
+	}
+
+	p.Trace.mark = end
+	t.record(s)
+}
+
+// Finish records the root span of p with the given result.
+func (t *Tracer) Finish(p Purge, result string) {
+	if t == nil || p.Trace == nil {
+		return
+	}
+
+	start := p.Received
+	if start.IsZero() {
+		start = p.Trace.mark
+	}
+
+	if result == sentResult && p.Trace.failed {
+		result = failedResult
+	}
+
+	attrs := []string{
+		"url.full", p.URL,
+		"purged.source", p.Source,
+		"purged.result", result,
+	}
+	if p.Topic != "" {
+		attrs = append(attrs,
+			"messaging.kafka.partition", strconv.Itoa(int(p.Partition)),
+			"messaging.kafka.message.offset", strconv.FormatInt(p.Offset, 10))
+	}
+	for _, kv := range [][2]string{
+		{"messaging.destination", p.Topic},
+		{"purged.layer", p.Layer},
+		{"purged.event_id", p.EventID},
+		{"purged.request_id", p.RequestID},
+	} {
+		if kv[1] != "" {
+			attrs = append(attrs, kv[0], kv[1])
+		}
+	}
+
+	s := span{
+		traceID: p.Trace.TraceID,
+		spanID:  p.Trace.RootID,
+		name:    "purge",
+		kind:    internalSpan,
+		start:   start,
+		end:     time.Now(),
+		attrs:   attrs,
+	}
+	if result != sentResult {
+		s.err = result
+	}
+	t.record(s)
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttributes(kv []string) []otlpKeyValue {
+	var attrs []otlpKeyValue
+	for i := 0; i+1 < len(kv); i += 2 {
+		attrs = append(attrs, otlpKeyValue{Key: kv[i], Value: otlpAnyValue{StringValue: kv[i+1]}})
+	}
+	return attrs
+}
+
+// encode returns the OTLP export request for spans.
+func (t *Tracer) encode(spans []span) ([]byte, error) {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		otlpSpans[i] = otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.err != "" {
+			otlpSpans[i].Status = otlpStatus{Code: errorStatus, Message: s.err}
+		}
+	}
+
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: otlpAttributes([]string{"service.name", t.service})},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "purged"},
+				Spans: otlpSpans,
+			}},
+		}},
+	})
+}
+
+// export sends spans to the collector.
+func (t *Tracer) export(spans []span) {
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := t.encode(spans)
+	if err == nil {
+		var resp *http.Response
+		resp, err = t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("Unexpected status %s", resp.Status)
+			}
+		}
+	}
+
+	status := "exported"
+	if err != nil {
+		status = "error"
+		exportErrorLog.Error("Error exporting spans", "endpoint", t.endpoint, "spans", len(spans), "err", err)
+	}
+	exportedSpans.With(prometheus.Labels{statusLabel: status}).Add(float64(len(spans)))
+}
+
+// Run exports spans in batches, at least every spanExportInterval.
+func (t *Tracer) Run() {
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+
+	var batch []span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < spanBatchLen {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-t.flush:
+			for empty := false; !empty; {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					empty = true
+				}
+			}
+			t.export(batch)
+			batch = nil
+			close(done)
+			continue
+		}
+
+		t.export(batch)
+		batch = nil
+	}
+}
+
+// Flush exports all recorded spans, waiting for Run to do so until timeout.
+func (t *Tracer) Flush(timeout time.Duration) {
+	if t == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	select {
+	case t.flush <- done:
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
+	case <-time.After(timeout):
+	}
+}
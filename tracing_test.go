@@ -0,0 +1,196 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a stand-in for an OpenTelemetry collector.
+type collector struct {
+	mutex sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *collector) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var export otlpRequest
+	if err := json.NewDecoder(req.Body).Decode(&export); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mutex.Lock()
+	for _, rs := range export.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	c.mutex.Unlock()
+}
+
+func (c *collector) byName() map[string]otlpSpan {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	spans := make(map[string]otlpSpan)
+	for _, s := range c.spans {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+func attribute(s otlpSpan, key string) string {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value.StringValue
+		}
+	}
+	return ""
+}
+
+func TestTracerSampling(t *testing.T) {
+	p := Purge{URL: "https://en.wikipedia.org/wiki/Main_Page"}
+
+	assertEquals(t, (*Tracer)(nil).Start(p) == nil, true)
+
+	tr := NewTracer("http://127.0.0.1:0/v1/traces", "purged")
+	defer otelSampleRate.Set(otelSampleRate.String())
+
+	otelSampleRate.Set("0")
+	assertEquals(t, tr.Start(p) == nil, true)
+
+	otelSampleRate.Set("1")
+	trace := tr.Start(p)
+	assertEquals(t, len(trace.TraceID), 32)
+	assertEquals(t, len(trace.RootID), 16)
+	assertEquals(t, trace.traceparent("00f067aa0ba902b7"), "00-"+trace.TraceID+"-00f067aa0ba902b7-01")
+
+	// Without a Trace
+	assertEquals(t, (*Trace)(nil).traceparent("00f067aa0ba902b7"), "")
+	assertEquals(t, (*Trace)(nil).newSpanID(), "")
+}
+
+func TestSendTraced(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assertEquals(t, req.Method, "PURGE")
+		assertEquals(t, req.Header.Get("traceparent"), traceparent)
+		rw.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+	parsedURL, _ := url.Parse(server.URL)
+
+	for _, client := range []PurgeClient{NewTCPPurger(parsedURL.Host), NewHTTPPurger(parsedURL.Host, httpPurgerOptions), NewATSRevalidator(NewTCPPurger(parsedURL.Host), "", time.Hour)} {
+		status, err := client.(RequestPurgeClient).SendRequest(PurgeRequest{Host: "en.wikipedia.org", URI: "/wiki/Main_Page", Traceparent: traceparent})
+		assertEquals(t, status, "200")
+		assertNotErr(t, err)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	c := &collector{}
+	otel := httptest.NewServer(c)
+	defer otel.Close()
+
+	defer otelSampleRate.Set(otelSampleRate.String())
+	otelSampleRate.Set("1")
+
+	tracer = NewTracer(otel.URL+"/v1/traces", "purged")
+	defer func() { tracer = nil }()
+	go tracer.Run()
+
+	var mutex sync.Mutex
+	traceparents := make(map[string]string)
+	cache := func(layer string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			traceparents[layer] = req.Header.Get("traceparent")
+			mutex.Unlock()
+			rw.Write([]byte(`OK`))
+		}))
+	}
+	backend := cache(backendValue)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	frontend := cache(frontendValue)
+	defer frontend.Close()
+	frontendURL, _ := url.Parse(frontend.URL)
+
+	queue, err := NewPriorityQueue("normal:1", "", "normal", 10)
+	assertNotErr(t, err)
+	chBackend := make(chan Purge)
+	go queue.Run(chBackend)
+
+	in, err := NewIngress(kafkaValue, nil, queue, nil)
+	assertNotErr(t, err)
+	chin := make(chan Purge, 1)
+	chin <- Purge{URL: "https://en.wikipedia.org/wiki/Main_Page", Source: kafkaValue, Topic: "eqiad.resource-purge", RequestID: "b2ec1c5c-9d5b-4c4b-a4a4-1d2ec2b8d5b4"}
+	ran := make(chan struct{})
+	go func() {
+		in.Run(chin)
+		close(ran)
+	}()
+	defer func() {
+		close(chin)
+		<-ran
+	}()
+
+	chFrontend := make(chan Purge, 1)
+	backends, frontends := startWorkers(backendURL.Host, frontendURL.Host, chBackend, chFrontend, nil)
+	defer backends.Resize(0)
+	defer frontends.Resize(0)
+
+	var spans map[string]otlpSpan
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		tracer.Flush(time.Second)
+		if spans = c.byName(); len(spans) == 7 {
+			break
+		}
+	}
+
+	root := spans["purge"]
+	assertEquals(t, root.ParentSpanID, "")
+	assertEquals(t, root.Status.Code, 0)
+	assertEquals(t, attribute(root, "purged.request_id"), "b2ec1c5c-9d5b-4c4b-a4a4-1d2ec2b8d5b4")
+	assertEquals(t, attribute(root, "messaging.destination"), "eqiad.resource-purge")
+	assertEquals(t, attribute(root, "purged.result"), sentResult)
+
+	for _, name := range []string{"ingress", "backend queue", "backend purge", "frontend delay", "frontend queue", "frontend purge"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Errorf("Span %s not exported", name)
+			continue
+		}
+		assertEquals(t, s.TraceID, root.TraceID)
+		assertEquals(t, s.ParentSpanID, root.SpanID)
+	}
+
+	assertEquals(t, attribute(spans["backend purge"], "http.response.status_code"), "200")
+
+	// The traceparent of each PURGE refers to its span
+	mutex.Lock()
+	defer mutex.Unlock()
+	assertEquals(t, traceparents[backendValue], "00-"+root.TraceID+"-"+spans["backend purge"].SpanID+"-01")
+	assertEquals(t, traceparents[frontendValue], "00-"+root.TraceID+"-"+spans["frontend purge"].SpanID+"-01")
+}
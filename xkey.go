@@ -0,0 +1,62 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	xkeyKind = "xkey"
+
+	// Surrogate keys are sent in a PURGE / request, space separated in a
+	// header the cache passes to xkey.purge()
+	xkeyReq = "PURGE / HTTP/1.1\r\nHost: %s\r\n%s: %s\r\nUser-Agent: purged\r\n%s\r\n"
+)
+
+var xkeyPurges = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "purged_xkey_requests_total",
+	Help: "Total number of surrogate key PURGE sent by status code",
+}, []string{
+	statusLabel,
+	layerLabel,
+})
+
+// xkeyHeaderValue returns the value of the xkey header for the given keys.
+func xkeyHeaderValue(keys []string) string {
+	return strings.Join(keys, " ")
+}
+
+func (p *TCPPurger) PurgeKeys(host string, keys []string) (string, error) {
+	req := fmt.Sprintf(xkeyReq, host, p.xkeyHeader, xkeyHeaderValue(keys), p.template.rawHeaders())
+	return p.send(req, fmt.Sprintf("keys %v (Host: %s)", keys, host))
+}
+
+func (p *HTTPPurger) PurgeKeys(host string, keys []string) (string, error) {
+	req, err := p.newRequest("PURGE", host, "/")
+	if err != nil {
+		return "", err
+	}
+	p.template.setExtraHeaders(req)
+	req.Header.Set(p.xkeyHeader, xkeyHeaderValue(keys))
+
+	return p.do(req)
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2020 Emanuele Rocca <ema@wikimedia.org>
+// Copyright (C) 2020 Wikimedia Foundation, Inc.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendPurgeKeys(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assertEquals(t, req.URL.String(), "/")
+		assertEquals(t, req.Method, "PURGE")
+		assertEquals(t, req.Host, "en.wikipedia.org")
+		assertEquals(t, req.Header.Get("xkey-purge"), "page:123 page:456")
+		rw.Write([]byte(`OK`))
+	}))
+	defer server.Close()
+	parsedURL, _ := url.Parse(server.URL)
+
+	tcpClient := NewTCPPurger(parsedURL.Host)
+	status, err := tcpClient.PurgeKeys("en.wikipedia.org", []string{"page:123", "page:456"})
+	assertEquals(t, status, "200")
+	assertEquals(t, err, nil)
+
+	httpClient := NewHTTPPurger(parsedURL.Host, httpPurgerOptions)
+	status, err = httpClient.PurgeKeys("en.wikipedia.org", []string{"page:123", "page:456"})
+	assertEquals(t, status, "200")
+	assertEquals(t, err, nil)
+}
+
+// Surrogate key purges are sent to both layers
+func TestWorkersPurgeKeys(t *testing.T) {
+	var mutex sync.Mutex
+	var keys []string
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		keys = append(keys, req.Header.Get(*xkeyHeader))
+		mutex.Unlock()
+		rw.Write([]byte(`OK`))
+	})
+
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	frontend := httptest.NewServer(handler)
+	defer frontend.Close()
+	frontendURL, _ := url.Parse(frontend.URL)
+
+	testCh := make(chan Purge, 10)
+	testFrCh := make(chan Purge, 10)
+	testCh <- Purge{URL: "https://en.wikipedia.org/", Kind: xkeyKind, Keys: []string{"page:123"}}
+
+	backends, frontends := startWorkers(backendURL.Host, frontendURL.Host, testCh, testFrCh, nil)
+	defer backends.Resize(0)
+	defer frontends.Resize(0)
+
+	for i := 0; i < 50; i++ {
+		mutex.Lock()
+		n := len(keys)
+		mutex.Unlock()
+		if n >= 2 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assertListEquals(t, keys, []string{"page:123", "page:123"})
+}